@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ready is set once the bot has connected to the forge and started its
+// campaigns, for /readyz.
+var ready int32
+
+// adminAPI lets operators control a running bot over HTTP. Every endpoint
+// but the probes needs the admin token as a bearer token.
+//
+//	GET    /healthz                     liveness probe
+//	GET    /readyz                      readiness probe
+//	GET    /status                      intake, campaigns and their queues
+//	POST   /intake/pause                stop taking on new repos
+//	POST   /intake/resume               take on new repos again
+//	POST   /campaigns/<name>/pause      pause a campaign
+//	POST   /campaigns/<name>/resume     resume a campaign
+//	POST   /queue?repo=owner/repo       process a repo now
+//	DELETE /queue?repo=owner/repo       drop a repo from the queue
+//	POST   /failed/retry[?repo=o/r]     queue failed repos to be retried
+//	POST   /denylist?owner=a&owner=b    never open PRs against these owners
+//	POST   /rescan                      run discovery again now
+//
+// The queue, retry and rescan endpoints take a campaign parameter when
+// there is more than one campaign. rescan without one rescans every
+// campaign.
+type adminAPI struct {
+	token string
+}
+
+// serveAdmin serves the admin API on addr until the process exits.
+func serveAdmin(addr, token string) {
+	a := &adminAPI{token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", a.healthz)
+	mux.HandleFunc("/readyz", a.readyz)
+	mux.HandleFunc("/status", a.auth(http.MethodGet, a.status))
+	mux.HandleFunc("/intake/pause", a.auth(http.MethodPost, a.pauseIntake))
+	mux.HandleFunc("/intake/resume", a.auth(http.MethodPost, a.resumeIntake))
+	mux.HandleFunc("/campaigns/", a.auth(http.MethodPost, a.campaign))
+	mux.HandleFunc("/queue", a.auth("", a.queue))
+	mux.HandleFunc("/failed/retry", a.auth(http.MethodPost, a.retryFailed))
+	mux.HandleFunc("/denylist", a.auth(http.MethodPost, a.denylist))
+	mux.HandleFunc("/rescan", a.auth(http.MethodPost, a.rescan))
+	logrus.Infof("Serving the admin API on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("admin API server failed: %v", err)
+	}
+}
+
+// auth wraps h to check the bearer token and, unless method is empty, the
+// request method.
+func (a *adminAPI) auth(method string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(a.token)) != 1 {
+			writeJSONError(w, http.StatusUnauthorized, fmt.Errorf("missing or wrong bearer token"))
+			return
+		}
+		if method != "" && r.Method != method {
+			writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("use %s", method))
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (a *adminAPI) healthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+func (a *adminAPI) readyz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&ready) == 0 {
+		http.Error(w, "starting", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// adminStatus is what /status returns.
+type adminStatus struct {
+	IntakePaused bool             `json:"intake_paused"`
+	Denylist     []string         `json:"denylist"`
+	Campaigns    []campaignStatus `json:"campaigns"`
+}
+
+type campaignStatus struct {
+	Name   string   `json:"name"`
+	Status string   `json:"status"`
+	Queue  []string `json:"queue"`
+}
+
+func currentStatus() adminStatus {
+	s := adminStatus{IntakePaused: intake.Paused()}
+	state.mu.Lock()
+	s.Denylist = append([]string{}, state.Denylist...)
+	state.mu.Unlock()
+	for _, c := range campaigns {
+		s.Campaigns = append(s.Campaigns, campaignStatus{Name: c.Name, Status: c.Status(), Queue: c.Queue()})
+	}
+	return s
+}
+
+func (a *adminAPI) status(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentStatus())
+}
+
+func (a *adminAPI) pauseIntake(w http.ResponseWriter, r *http.Request) {
+	intake.pause()
+	logrus.Info("Intake paused from the admin API")
+	writeJSON(w, http.StatusOK, currentStatus())
+}
+
+func (a *adminAPI) resumeIntake(w http.ResponseWriter, r *http.Request) {
+	intake.resume()
+	logrus.Info("Intake resumed from the admin API")
+	writeJSON(w, http.StatusOK, currentStatus())
+}
+
+// campaign handles /campaigns/<name>/pause and /campaigns/<name>/resume.
+func (a *adminAPI) campaign(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/campaigns/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("use /campaigns/<name>/pause or resume"))
+		return
+	}
+	c := findCampaign(path[:i])
+	if c == nil {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("no campaign %q", path[:i]))
+		return
+	}
+	switch path[i+1:] {
+	case "pause":
+		c.pause()
+	case "resume":
+		c.resume()
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("use /campaigns/<name>/pause or resume"))
+		return
+	}
+	logrus.Infof("Campaign %q is now %s", c.Name, c.Status())
+	writeJSON(w, http.StatusOK, currentStatus())
+}
+
+// queue adds a repo to the queue of a campaign, or drops it.
+func (a *adminAPI) queue(w http.ResponseWriter, r *http.Request) {
+	c, err := requestCampaign(r)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	repo := r.FormValue("repo")
+	if _, _, err := splitRepoName(repo); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if state.denied(strings.SplitN(repo, "/", 2)[0]) {
+			writeJSONError(w, http.StatusConflict, fmt.Errorf("the owner of %s is on the denylist", repo))
+			return
+		}
+		if !c.enqueue(repo) {
+			writeJSONError(w, http.StatusConflict, fmt.Errorf("%s is queued already", repo))
+			return
+		}
+		logrus.Infof("Queued %s from the admin API", repo)
+		writeJSON(w, http.StatusAccepted, currentStatus())
+	case http.MethodDelete:
+		if !c.drop(repo) {
+			writeJSONError(w, http.StatusNotFound, fmt.Errorf("%s is not queued", repo))
+			return
+		}
+		logrus.Infof("Dropped %s from the queue from the admin API", repo)
+		writeJSON(w, http.StatusOK, currentStatus())
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("use POST or DELETE"))
+	}
+}
+
+// retryFailed queues the failed repo given, or every failed repo of the
+// campaign if none is, so they are retried one at a time with the rest of
+// the queue.
+func (a *adminAPI) retryFailed(w http.ResponseWriter, r *http.Request) {
+	c, err := requestCampaign(r)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, err)
+		return
+	}
+	queued := queueFailed(c, r.FormValue("repo"))
+	if len(queued) == 0 {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("nothing to retry"))
+		return
+	}
+	logrus.Infof("Queued %d failed repositories from the admin API", len(queued))
+	writeJSON(w, http.StatusAccepted, map[string][]string{"queued": queued})
+}
+
+func (a *adminAPI) denylist(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	owners := r.Form["owner"]
+	if len(owners) == 0 {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("pass the owners to deny as owner parameters"))
+		return
+	}
+	if err := state.deny(owners...); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	logrus.Infof("Denylisted %s from the admin API", strings.Join(owners, ", "))
+	writeJSON(w, http.StatusOK, currentStatus())
+}
+
+func (a *adminAPI) rescan(w http.ResponseWriter, r *http.Request) {
+	targets := campaigns
+	if r.FormValue("campaign") != "" {
+		c, err := requestCampaign(r)
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err)
+			return
+		}
+		targets = []*campaign{c}
+	}
+	var started []string
+	for _, c := range targets {
+		if c.triggerRescan() {
+			started = append(started, c.Name)
+		}
+	}
+	if len(started) == 0 {
+		writeJSONError(w, http.StatusConflict, fmt.Errorf("no campaign is running"))
+		return
+	}
+	writeJSON(w, http.StatusAccepted, map[string][]string{"rescanning": started})
+}
+
+// requestCampaign returns the campaign named by the campaign parameter of r,
+// which may be left out when there is only one.
+func requestCampaign(r *http.Request) (*campaign, error) {
+	name := r.FormValue("campaign")
+	if name == "" && len(campaigns) == 1 {
+		return campaigns[0], nil
+	}
+	if c := findCampaign(name); c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf("no campaign %q", name)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// markReady flips /readyz to ok.
+func markReady() {
+	atomic.StoreInt32(&ready, 1)
+}
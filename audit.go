@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The events written to the audit log.
+const (
+	eventSearched   = "searched"
+	eventDiscovered = "discovered"
+	eventSkipped    = "skipped"
+	eventForked     = "forked"
+	eventBranched   = "branched"
+	eventCommitted  = "committed"
+	eventPROpened   = "pr-opened"
+	eventChecks     = "checks"
+	eventMerged     = "merged"
+	eventFailed     = "failed"
+)
+
+// auditEvent is a single line of the audit log.
+type auditEvent struct {
+	Time          time.Time `json:"time"`
+	Event         string    `json:"event"`
+	Repo          string    `json:"repo,omitempty"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Source        string    `json:"source,omitempty"`
+	Stage         string    `json:"stage,omitempty"`
+	Reason        string    `json:"reason,omitempty"`
+	Detail        string    `json:"detail,omitempty"`
+	SHA           string    `json:"sha,omitempty"`
+	URL           string    `json:"url,omitempty"`
+	Error         string    `json:"error,omitempty"`
+	Count         int       `json:"count,omitempty"`
+}
+
+// auditLog appends events as JSON lines to a file.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+
+	// ids holds the correlation ID of every repo seen in this run.
+	ids map[string]string
+}
+
+// audit is the audit log of this run. Events are dropped if it is nil.
+var audit *auditLog
+
+func openAuditLog(path string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{file: file, enc: json.NewEncoder(file), ids: map[string]string{}}, nil
+}
+
+// correlationID returns the ID tying together all events about repo in this
+// run, making one up the first time repo is seen.
+func (l *auditLog) correlationID(repo string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.idLocked(repo)
+}
+
+func (l *auditLog) idLocked(repo string) string {
+	id, ok := l.ids[repo]
+	if !ok {
+		b := make([]byte, 8)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+		l.ids[repo] = id
+	}
+	return id
+}
+
+// record writes e, filling in the time and the correlation ID of its repo.
+// The dashboard keeps the latest events even without an audit log.
+func (l *auditLog) record(e auditEvent) {
+	e.Time = time.Now().UTC()
+	if l == nil {
+		recentEvents.add(e)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e.Repo != "" {
+		e.CorrelationID = l.idLocked(e.Repo)
+	}
+	recentEvents.add(e)
+	if err := l.enc.Encode(e); err != nil {
+		logrus.Warnf("writing audit log failed: %v", err)
+	}
+}
+
+// repoLog returns a logger tagged with the correlation ID of repo, so the
+// normal logs can be joined with the audit log.
+func repoLog(repo string) *logrus.Entry {
+	entry := logrus.WithField("repo", repo)
+	if audit != nil {
+		entry = entry.WithField("correlation_id", audit.correlationID(repo))
+	}
+	return entry
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// The states a campaign can be in.
+const (
+	campaignRunning = "running"
+	campaignPaused  = "paused"
+	campaignStopped = "stopped"
+)
+
+// pipelinePace is how long the pipeline waits between opening PRs when a
+// campaign runs alone. Campaigns running side by side split it by their
+// rate share.
+const pipelinePace = 3 * time.Second
+
+// campaign is a named unit of work: where repos come from, the rules run
+// against them, the policy deciding who gets a PR and the state file that
+// remembers it all. Campaigns run side by side and are paused, resumed and
+// stopped on their own.
+type campaign struct {
+	Name string
+
+	src    source
+	rules  []*rule
+	policy eligibilityPolicy
+	// branchPrefix starts the branches fixes are pushed to. The default
+	// campaign leaves it empty and uses the default branch of forks.
+	branchPrefix string
+	rateShare    int
+	// interval is how long to wait before discovering repos again, zero
+	// to stop after one pass.
+	interval time.Duration
+	state    *stateStore
+
+	mu      sync.Mutex
+	status  string
+	resumed chan struct{}
+	cancel  context.CancelFunc
+	// running is set while run is discovering repos or waiting for the
+	// next pass.
+	running bool
+	// queue holds the repos asked for by name, processed ahead of
+	// discovery. queued and rescan wake run up.
+	queue  []string
+	queued chan struct{}
+	rescan chan struct{}
+}
+
+// campaigns are the campaigns of this run.
+var campaigns []*campaign
+
+// intake holds off discovery and queued repos in every campaign while it
+// is paused. Work already under way carries on.
+var intake = &intakeGate{}
+
+type intakeGate struct {
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+}
+
+func (g *intakeGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *intakeGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+	}
+}
+
+// Paused reports whether intake is paused.
+func (g *intakeGate) Paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused
+}
+
+// wait blocks while intake is paused. It returns false if ctx is done
+// first.
+func (g *intakeGate) wait(ctx context.Context) bool {
+	g.mu.Lock()
+	paused, resumed := g.paused, g.resumed
+	g.mu.Unlock()
+	if !paused {
+		return true
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-resumed:
+		return true
+	}
+}
+
+// eligibilityPolicy decides which repos a campaign opens PRs against on top
+// of the rules matching.
+type eligibilityPolicy struct {
+	// MinGoVersion skips repos whose Travis file builds with an older Go.
+	MinGoVersion string   `yaml:"min_go_version"`
+	MinStars     int      `yaml:"min_stars"`
+	SkipForks    bool     `yaml:"skip_forks"`
+	AutoMerge    []string `yaml:"automerge"`
+
+	minGo *semver.Version
+}
+
+// campaignConfig is a campaign as written in the -campaigns file.
+type campaignConfig struct {
+	Name string `yaml:"name"`
+	// At most one of Repo, ReposFile and Owner. Code search with Search,
+	// or the built in query, is used when none is given.
+	Search    string `yaml:"search"`
+	Repo      string `yaml:"repo"`
+	ReposFile string `yaml:"repos_file"`
+	Owner     string `yaml:"owner"`
+
+	Rules        []string          `yaml:"rules"`
+	Policy       eligibilityPolicy `yaml:"policy"`
+	Templates    string            `yaml:"templates"`
+	BranchPrefix string            `yaml:"branch_prefix"`
+	RateShare    int               `yaml:"rate_share"`
+	Interval     time.Duration     `yaml:"interval"`
+	// State is the state file, by default campaigns/<name>.json next to
+	// -state.
+	State string `yaml:"state"`
+	// Status is running, paused or stopped.
+	Status string `yaml:"status"`
+}
+
+type campaignsFile struct {
+	Campaigns []campaignConfig `yaml:"campaigns"`
+}
+
+func readCampaignsFile(path string) ([]campaignConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file campaignsFile
+	if err := yaml.UnmarshalStrict(b, &file); err != nil {
+		return nil, err
+	}
+	return file.Campaigns, nil
+}
+
+// loadCampaigns creates the campaigns described in the file at path.
+func loadCampaigns(path string) ([]*campaign, error) {
+	configs, err := readCampaignsFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no campaigns in %s", path)
+	}
+
+	seen := map[string]bool{}
+	var result []*campaign
+	for _, cfg := range configs {
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("campaign %q is defined twice", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		c, err := newCampaign(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("campaign %q: %v", cfg.Name, err)
+		}
+		result = append(result, c)
+	}
+	return result, nil
+}
+
+// newCampaign creates a campaign from its configuration.
+func newCampaign(cfg campaignConfig) (*campaign, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("campaigns need a name")
+	}
+	query := cfg.Search
+	if query == "" {
+		query = searchQuery
+	}
+	src, err := newSourceFrom(cfg.Repo, cfg.ReposFile, cfg.Owner, query, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.Rules) == 0 {
+		return nil, fmt.Errorf("no rules given")
+	}
+	var ruleSet []*rule
+	for _, name := range cfg.Rules {
+		r := findRule(name)
+		if r == nil {
+			return nil, fmt.Errorf("unknown rule %q", name)
+		}
+		ruleSet = append(ruleSet, r)
+	}
+
+	prefix := cfg.BranchPrefix
+	if prefix == "" {
+		prefix = directBranchPrefix + cfg.Name + "/"
+	}
+	path := cfg.State
+	if path == "" {
+		path = filepath.Join(filepath.Dir(statePath), "campaigns", cfg.Name+".json")
+	}
+	return buildCampaign(cfg.Name, src, ruleSet, cfg.Policy, cfg.Templates, prefix, cfg.RateShare, cfg.Interval, path, cfg.Status)
+}
+
+// defaultCampaign creates the single campaign the global flags describe.
+// It keeps its state in the -state file.
+func defaultCampaign() (*campaign, error) {
+	src, err := newSource()
+	if err != nil {
+		return nil, err
+	}
+	c, err := buildCampaign(campaignName, src, rules, eligibilityPolicy{}, "", "", 1, 0, "", campaignRunning)
+	if err != nil {
+		return nil, err
+	}
+	c.state = state
+	return c, nil
+}
+
+func buildCampaign(name string, src source, ruleSet []*rule, policy eligibilityPolicy, templates, branchPrefix string, rateShare int, interval time.Duration, path, status string) (*campaign, error) {
+	if policy.MinGoVersion != "" {
+		v, err := semver.ParseTolerant(policy.MinGoVersion)
+		if err != nil {
+			return nil, fmt.Errorf("min_go_version: %v", err)
+		}
+		policy.minGo = &v
+	}
+	if rateShare <= 0 {
+		rateShare = 1
+	}
+	switch status {
+	case "":
+		status = campaignRunning
+	case campaignRunning, campaignPaused, campaignStopped:
+	default:
+		return nil, fmt.Errorf("unknown status %q, must be running, paused or stopped", status)
+	}
+
+	// Every campaign gets its own copy of the rules, so templates, trailers
+	// and auto-merge orgs don't leak from one campaign to another.
+	var own []*rule
+	for _, r := range ruleSet {
+		cp := *r
+		cp.campaign = name
+		cp.AutoMergeOrgs = append(append([]string{}, r.AutoMergeOrgs...), policy.AutoMerge...)
+		own = append(own, &cp)
+	}
+	if templates != "" {
+		if err := loadTemplates(templates, own); err != nil {
+			return nil, fmt.Errorf("loading templates failed: %v", err)
+		}
+	}
+
+	c := &campaign{
+		Name:         name,
+		src:          src,
+		rules:        own,
+		policy:       policy,
+		branchPrefix: branchPrefix,
+		rateShare:    rateShare,
+		interval:     interval,
+		status:       campaignRunning,
+		queued:       make(chan struct{}, 1),
+		rescan:       make(chan struct{}, 1),
+	}
+	switch status {
+	case campaignPaused:
+		c.pause()
+	case campaignStopped:
+		c.status = campaignStopped
+	}
+	if path != "" {
+		var err error
+		c.state, err = openStateStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("opening state file %s failed: %v", path, err)
+		}
+	}
+	return c, nil
+}
+
+// findCampaign returns the campaign called name, or nil.
+func findCampaign(name string) *campaign {
+	for _, c := range campaigns {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// currentCampaign returns the campaign a subcommand works on: the one
+// named with -campaign, or the only one there is.
+func currentCampaign() (*campaign, error) {
+	if len(campaigns) == 1 {
+		return campaigns[0], nil
+	}
+	if c := findCampaign(campaignName); c != nil {
+		return c, nil
+	}
+	var names []string
+	for _, c := range campaigns {
+		names = append(names, c.Name)
+	}
+	return nil, fmt.Errorf("pass -campaign with one of %s", strings.Join(names, ", "))
+}
+
+// forkBranch is the branch in the bot's fork the fix for r goes on. The
+// default campaign uses the default branch of the fork, which it gets from
+// upstream, so repo can be either.
+func (c *campaign) forkBranch(r *rule, repo *forgeRepo) string {
+	if c.branchPrefix == "" {
+		if repo.DefaultBranch == "" {
+			return "master"
+		}
+		return repo.DefaultBranch
+	}
+	return c.branchPrefix + r.Name
+}
+
+// directBranch is the branch in upstream the fix for r goes on when the
+// bot can push there.
+func (c *campaign) directBranch(r *rule) string {
+	if c.branchPrefix == "" {
+		return directBranchPrefix + r.Name
+	}
+	return c.branchPrefix + r.Name
+}
+
+// allowsGoVersions reports whether the Go versions in a Travis file are
+// new enough for the policy.
+func (p *eligibilityPolicy) allowsGoVersions(travisFile string) bool {
+	if p.minGo == nil {
+		return true
+	}
+	return checkValidGoVersion([]byte(travisFile), *p.minGo)
+}
+
+// allowsRepo checks the parts of the policy that need the full repo, which
+// search results don't have. It returns why repo is not allowed.
+func (p *eligibilityPolicy) allowsRepo(repo *forgeRepo) (string, string) {
+	if p.SkipForks && repo.Fork {
+		return "fork", "repository is a fork"
+	}
+	if repo.Stars < p.MinStars {
+		return "few-stars", fmt.Sprintf("repository has %d stars, fewer than %d", repo.Stars, p.MinStars)
+	}
+	return "", ""
+}
+
+// Status returns whether c is running, paused or stopped.
+func (c *campaign) Status() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.status
+}
+
+// pause stops c from sending more repos down the pipeline. Work already
+// under way carries on.
+func (c *campaign) pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status != campaignRunning {
+		return
+	}
+	c.status = campaignPaused
+	c.resumed = make(chan struct{})
+}
+
+// resume lets a paused campaign carry on.
+func (c *campaign) resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status != campaignPaused {
+		return
+	}
+	c.status = campaignRunning
+	close(c.resumed)
+}
+
+// stop ends c for good, cancelling the work it has under way.
+func (c *campaign) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.status == campaignPaused {
+		close(c.resumed)
+	}
+	c.status = campaignStopped
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+// setStatus moves c to status.
+func (c *campaign) setStatus(status string) {
+	switch status {
+	case campaignRunning, "":
+		c.resume()
+	case campaignPaused:
+		c.pause()
+	case campaignStopped:
+		c.stop()
+	}
+}
+
+// wait blocks while c or intake is paused. It returns false once c is
+// stopped or ctx is done.
+func (c *campaign) wait(ctx context.Context) bool {
+	for {
+		c.mu.Lock()
+		status, resumed := c.status, c.resumed
+		c.mu.Unlock()
+
+		switch status {
+		case campaignStopped:
+			return false
+		case campaignRunning:
+			if intake.Paused() {
+				if !intake.wait(ctx) {
+					return false
+				}
+				continue
+			}
+			return ctx.Err() == nil
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-resumed:
+		}
+	}
+}
+
+// pace is how long c waits between opening PRs: its share of the pace of
+// all campaigns that are not stopped.
+func (c *campaign) pace() time.Duration {
+	total := 0
+	for _, other := range campaigns {
+		if other == c || other.Status() != campaignStopped {
+			total += other.rateShare
+		}
+	}
+	if total == 0 {
+		return pipelinePace
+	}
+	return pipelinePace * time.Duration(total) / time.Duration(c.rateShare)
+}
+
+// run discovers repos and fixes them until the sources run dry, or every
+// interval until c is stopped or ctx is done. With the admin API or a
+// control repo on, a campaign without an interval waits for a rescan
+// instead of returning, so repos queued by hand are still processed.
+// Queued repos are processed as they come in.
+func (c *campaign) run(ctx context.Context, f forge, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	c.mu.Lock()
+	if c.status == campaignStopped {
+		c.mu.Unlock()
+		logrus.Infof("Campaign %q is stopped", c.Name)
+		return
+	}
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.running = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.running = false
+		c.mu.Unlock()
+		c.cancel()
+	}()
+
+	// pick up watching PRs opened before a restart
+	var checks sync.WaitGroup
+	resumeChecks(ctx, f, c.state, &checks)
+	defer checks.Wait()
+
+	queueCtx, stopQueue := context.WithCancel(ctx)
+	defer stopQueue()
+	checks.Add(1)
+	go c.processQueue(queueCtx, f, &checks)
+
+	for c.wait(ctx) {
+		logrus.WithField("campaign", c.Name).Infof("Discovering repositories from %s", c.src.Name())
+		runPipeline(ctx, f, c, func(targets chan<- *fixTarget, wg *sync.WaitGroup) {
+			discoverRepos(ctx, f, c, targets, wg)
+		})
+
+		var next <-chan time.Time
+		if c.interval > 0 {
+			next = time.After(c.interval)
+		} else if adminAddr == "" && controlRepo == "" {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.rescan:
+			logrus.WithField("campaign", c.Name).Info("Rescan requested")
+		case <-next:
+		}
+	}
+}
+
+// enqueue asks for repo to be processed ahead of discovery. It reports
+// whether repo was not queued already.
+func (c *campaign) enqueue(repo string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range c.queue {
+		if name == repo {
+			return false
+		}
+	}
+	c.queue = append(c.queue, repo)
+	select {
+	case c.queued <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// drop takes repo off the queue and reports whether it was on it.
+func (c *campaign) drop(repo string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, name := range c.queue {
+		if name == repo {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Queue returns the repos waiting to be processed.
+func (c *campaign) Queue() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.queue...)
+}
+
+// next takes the first repo off the queue, or returns "" if it is empty.
+func (c *campaign) next() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.queue) == 0 {
+		return ""
+	}
+	repo := c.queue[0]
+	c.queue = c.queue[1:]
+	return repo
+}
+
+// triggerRescan starts the next discovery pass of c now. It reports false
+// if c is not running.
+func (c *campaign) triggerRescan() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.running {
+		return false
+	}
+	select {
+	case c.rescan <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// processQueue sends queued repos down the pipeline one at a time until ctx
+// is done. A queued repo that failed before is re-driven from where it
+// failed.
+func (c *campaign) processQueue(ctx context.Context, f forge, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.queued:
+		}
+		for c.wait(ctx) {
+			name := c.next()
+			if name == "" {
+				break
+			}
+			logrus.WithField("campaign", c.Name).Infof("Processing queued repository %s", name)
+			runPipeline(ctx, f, c, func(targets chan<- *fixTarget, wg *sync.WaitGroup) {
+				if _, dl, _ := c.state.lookup(name); dl != nil {
+					redriveDeadLetters(ctx, f, c, []*deadLetter{dl}, targets, wg)
+					return
+				}
+				defer close(targets)
+				defer wg.Done()
+
+				repo, attempts, err := fetchRepo(ctx, f, name)
+				if err != nil {
+					c.recordFailure(name, stageUpstreamCheck, attempts, err)
+					return
+				}
+				if r := isEligible(ctx, f, c, repo); r != nil {
+					targets <- &fixTarget{upstream: repo, rule: r}
+				}
+			})
+		}
+	}
+}
+
+// reloadCampaigns applies the statuses in the campaigns file at path to
+// the running campaigns.
+func reloadCampaigns(path string) error {
+	configs, err := readCampaignsFile(path)
+	if err != nil {
+		return err
+	}
+	for _, cfg := range configs {
+		c := findCampaign(cfg.Name)
+		if c == nil {
+			logrus.Warnf("campaign %q was added to %s, restart to run it", cfg.Name, path)
+			continue
+		}
+		if before := c.Status(); before != cfg.Status && !(before == campaignRunning && cfg.Status == "") {
+			c.setStatus(cfg.Status)
+			logrus.Infof("Campaign %q is now %s", c.Name, c.Status())
+		}
+	}
+	return nil
+}
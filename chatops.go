@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// chatOpsHelp is the reply to /help.
+const chatOpsHelp = "Commands:\n\n" +
+	"- `/pause [campaign]` stops taking on new repos, in every campaign or one\n" +
+	"- `/resume [campaign]` takes on new repos again\n" +
+	"- `/run owner/repo [campaign]` processes a repo now, ahead of discovery\n" +
+	"- `/denylist owner...` never opens PRs against these owners\n" +
+	"- `/status` shows intake, campaigns and their queues"
+
+// chatOps takes slash commands from the comments on the issues of a control
+// repository and replies to them there. Only members of team are obeyed.
+type chatOps struct {
+	f    forge
+	repo *forgeRepo
+	team string
+	// handled holds when the comments already answered were made, since
+	// polling for the comments since the last one seen returns it again.
+	// Older comments are dropped from it once since moves past them.
+	handled map[int64]time.Time
+}
+
+// watchControlRepo polls the issues of the control repo for commands every
+// interval until ctx is done. Only comments made after it starts count.
+func watchControlRepo(ctx context.Context, f forge, repoName, team string) {
+	repo, err := getRepo(ctx, f, repoName)
+	if err != nil {
+		logrus.Errorf("getting control repo %s failed, ChatOps is off: %v", repoName, err)
+		return
+	}
+	ops := &chatOps{f: f, repo: repo, team: team, handled: map[int64]time.Time{}}
+	logrus.Infof("Taking commands from members of %s in the issues of %s", team, repoName)
+
+	since := time.Now().UTC()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		comments, err := f.IssueComments(ctx, repo, since)
+		if err != nil {
+			logrus.Warnf("reading commands from %s failed: %v", repoName, err)
+			continue
+		}
+		since = ops.take(ctx, comments, since)
+	}
+}
+
+// take handles the comments made since and returns when the newest one was
+// made, to poll from next. Comments made before since are old ones that
+// were edited.
+func (ops *chatOps) take(ctx context.Context, comments []*forgeComment, since time.Time) time.Time {
+	newest := since
+	for _, c := range comments {
+		if c.CreatedAt.Before(since) {
+			continue
+		}
+		if c.CreatedAt.After(newest) {
+			newest = c.CreatedAt
+		}
+		if _, ok := ops.handled[c.ID]; ok {
+			continue
+		}
+		ops.handled[c.ID] = c.CreatedAt
+		ops.handle(ctx, c)
+	}
+	for id, created := range ops.handled {
+		if created.Before(newest) {
+			delete(ops.handled, id)
+		}
+	}
+	return newest
+}
+
+// handle runs the command in c, if there is one, and replies with the
+// result.
+func (ops *chatOps) handle(ctx context.Context, c *forgeComment) {
+	if c.Author == botLogin {
+		return
+	}
+	line := strings.TrimSpace(strings.SplitN(c.Body, "\n", 2)[0])
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return
+	}
+	command, args := fields[0], fields[1:]
+	switch command {
+	case "/pause", "/resume", "/run", "/denylist", "/status", "/help":
+	default:
+		// Other bots read slash commands too.
+		logrus.Debugf("ignoring %s from %s in %s#%d", command, c.Author, ops.repo.FullName(), c.Issue)
+		return
+	}
+
+	member, err := ops.f.IsTeamMember(ctx, ops.team, c.Author)
+	if err != nil {
+		logrus.Warnf("checking whether %s is in %s failed: %v", c.Author, ops.team, err)
+		ops.reply(ctx, c, fmt.Sprintf("@%s I could not check that you are a member of %s, so I did not run `%s`.", c.Author, ops.team, line))
+		return
+	}
+	if !member {
+		logrus.Warnf("%s is not in %s, ignoring %s", c.Author, ops.team, line)
+		ops.reply(ctx, c, fmt.Sprintf("@%s only members of %s can run commands.", c.Author, ops.team))
+		return
+	}
+
+	logrus.Infof("Running %s for %s from %s#%d", line, c.Author, ops.repo.FullName(), c.Issue)
+	result, err := runChatOpsCommand(command, args)
+	if err != nil {
+		result = fmt.Sprintf("`%s` failed: %v", line, err)
+	}
+	ops.reply(ctx, c, fmt.Sprintf("@%s %s", c.Author, result))
+}
+
+func (ops *chatOps) reply(ctx context.Context, c *forgeComment, body string) {
+	if err := ops.f.CreateComment(ctx, ops.repo, c.Issue, body); err != nil {
+		logrus.Warnf("replying on %s#%d failed: %v", ops.repo.FullName(), c.Issue, err)
+	}
+}
+
+// runChatOpsCommand runs a command and returns what to reply.
+func runChatOpsCommand(command string, args []string) (string, error) {
+	switch command {
+	case "/pause", "/resume":
+		if len(args) == 0 {
+			if command == "/pause" {
+				intake.pause()
+				return "Intake is paused. Work already under way carries on.", nil
+			}
+			intake.resume()
+			return "Intake is resumed.", nil
+		}
+		c := findCampaign(args[0])
+		if c == nil {
+			return "", fmt.Errorf("no campaign %q", args[0])
+		}
+		if command == "/pause" {
+			c.pause()
+		} else {
+			c.resume()
+		}
+		return fmt.Sprintf("Campaign %s is %s.", c.Name, c.Status()), nil
+
+	case "/run":
+		if len(args) == 0 {
+			return "", fmt.Errorf("pass the repository to run as owner/repo")
+		}
+		owner, _, err := splitRepoName(args[0])
+		if err != nil {
+			return "", err
+		}
+		c, err := commandCampaign(args[1:])
+		if err != nil {
+			return "", err
+		}
+		if state.denied(owner) {
+			return "", fmt.Errorf("%s is on the denylist", owner)
+		}
+		if !c.enqueue(args[0]) {
+			return fmt.Sprintf("%s is queued already.", args[0]), nil
+		}
+		return fmt.Sprintf("Queued %s.", args[0]), nil
+
+	case "/denylist":
+		if len(args) == 0 {
+			return "", fmt.Errorf("pass the owners to deny")
+		}
+		if err := state.deny(args...); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Denylisted %s.", strings.Join(args, ", ")), nil
+
+	case "/status":
+		return chatOpsStatus(), nil
+	}
+	return chatOpsHelp, nil
+}
+
+// commandCampaign returns the campaign named in args, which may be left out
+// when there is only one.
+func commandCampaign(args []string) (*campaign, error) {
+	if len(args) == 0 {
+		if len(campaigns) == 1 {
+			return campaigns[0], nil
+		}
+		return nil, fmt.Errorf("pass the campaign, there are %d", len(campaigns))
+	}
+	if c := findCampaign(args[0]); c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf("no campaign %q", args[0])
+}
+
+// chatOpsStatus formats the status for a comment.
+func chatOpsStatus() string {
+	s := currentStatus()
+	var buf bytes.Buffer
+	buf.WriteString("Status:\n\n```\n")
+	w := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	intakeStatus := "running"
+	if s.IntakePaused {
+		intakeStatus = "paused"
+	}
+	fmt.Fprintf(w, "intake\t%s\n", intakeStatus)
+	if len(s.Denylist) > 0 {
+		fmt.Fprintf(w, "denylist\t%s\n", strings.Join(s.Denylist, ", "))
+	}
+	for _, c := range s.Campaigns {
+		name := c.Name
+		if name == "" {
+			name = "default"
+		}
+		fmt.Fprintf(w, "campaign %s\t%s, %d queued\n", name, c.Status, len(c.Queue))
+	}
+	w.Flush()
+	buf.WriteString("```")
+	return buf.String()
+}
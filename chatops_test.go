@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// chatForge lets everyone run commands and keeps the replies. Every other
+// forge method panics.
+type chatForge struct {
+	forge
+	replies []int64
+}
+
+func (f *chatForge) IsTeamMember(ctx context.Context, team, user string) (bool, error) {
+	return true, nil
+}
+
+func (f *chatForge) CreateComment(ctx context.Context, repo *forgeRepo, number int, body string) error {
+	f.replies = append(f.replies, int64(number))
+	return nil
+}
+
+func TestChatOpsTake(t *testing.T) {
+	start := time.Date(2018, 10, 1, 12, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Duration(minutes) * time.Minute) }
+	// The issue number is the comment ID, to tell the replies apart.
+	help := func(id int64, minutes int) *forgeComment {
+		return &forgeComment{ID: id, Issue: int(id), Author: "alice", Body: "/help", CreatedAt: at(minutes)}
+	}
+
+	testCases := []struct {
+		name        string
+		comments    []*forgeComment
+		wantSince   time.Time
+		wantReplies []int64
+		wantHandled []int64
+	}{
+		{
+			name:        "made before the watcher started",
+			comments:    []*forgeComment{help(1, -10)},
+			wantSince:   start,
+			wantReplies: nil,
+			wantHandled: nil,
+		},
+		{
+			name:        "new comments",
+			comments:    []*forgeComment{help(2, 1), help(3, 2)},
+			wantSince:   at(2),
+			wantReplies: []int64{2, 3},
+			wantHandled: []int64{3},
+		},
+		{
+			name:        "the newest comment comes back",
+			comments:    []*forgeComment{help(3, 2)},
+			wantSince:   at(2),
+			wantReplies: nil,
+			wantHandled: []int64{3},
+		},
+		{
+			name:        "an edited old comment comes back",
+			comments:    []*forgeComment{help(2, 1), help(4, 3)},
+			wantSince:   at(3),
+			wantReplies: []int64{4},
+			wantHandled: []int64{4},
+		},
+		{
+			name:        "comments made at the same time",
+			comments:    []*forgeComment{help(5, 3), help(4, 3)},
+			wantSince:   at(3),
+			wantReplies: []int64{5},
+			wantHandled: []int64{4, 5},
+		},
+	}
+
+	f := &chatForge{}
+	ops := &chatOps{f: f, repo: &forgeRepo{Owner: "a", Name: "control"}, team: "org/ops", handled: map[int64]time.Time{}}
+	since := start
+	for _, tc := range testCases {
+		f.replies = nil
+		since = ops.take(context.Background(), tc.comments, since)
+
+		var handled []int64
+		for id := range ops.handled {
+			handled = append(handled, id)
+		}
+		sort.Slice(handled, func(i, j int) bool { return handled[i] < handled[j] })
+		if !since.Equal(tc.wantSince) {
+			t.Errorf("%s: got since %s, want %s", tc.name, since, tc.wantSince)
+		}
+		if !reflect.DeepEqual(f.replies, tc.wantReplies) {
+			t.Errorf("%s: replied to %v, want %v", tc.name, f.replies, tc.wantReplies)
+		}
+		if !reflect.DeepEqual(handled, tc.wantHandled) {
+			t.Errorf("%s: kept %v as handled, want %v", tc.name, handled, tc.wantHandled)
+		}
+	}
+}
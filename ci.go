@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ciPollInterval is how often the checks of a bot PR are looked at.
+	ciPollInterval = 2 * time.Minute
+	// ciTimeout is how long checks may stay pending before we stop
+	// watching them.
+	ciTimeout = 6 * time.Hour
+)
+
+// prState is what the bot knows about the PR it opened against a repo.
+type prState struct {
+	Number int    `json:"number"`
+	URL    string `json:"url"`
+	// Rule and Campaign come from the trailers of the PR's commit.
+	Rule     string     `json:"rule,omitempty"`
+	Campaign string     `json:"campaign,omitempty"`
+	HeadSHA  string     `json:"head_sha"`
+	BaseSHA  string     `json:"base_sha,omitempty"`
+	Checks   checkState `json:"checks"`
+	// State is "open", "merged" or "closed" as last seen.
+	State string `json:"state,omitempty"`
+	// BrokeBuild is set when the checks fail on the PR but passed on the
+	// commit it was based on, so the failure is likely ours.
+	BrokeBuild bool      `json:"broke_build,omitempty"`
+	CheckedAt  time.Time `json:"checked_at,omitempty"`
+	OpenedAt   time.Time `json:"opened_at,omitempty"`
+	ClosedAt   time.Time `json:"closed_at,omitempty"`
+	// CloseReason sums up why a maintainer closed the PR without merging
+	// it, taken from CloseComment, their last comment on it.
+	CloseReason  string `json:"close_reason,omitempty"`
+	CloseComment string `json:"close_comment,omitempty"`
+	// Diff is the change the PR makes, as a unified diff.
+	Diff string `json:"diff,omitempty"`
+}
+
+// recordPR stores a newly opened PR with its checks still pending, along
+// with the provenance trailers of its commit and the diff it makes.
+func (s *stateStore) recordPR(name string, pr *forgePR, trailers map[string]string, diff string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	opened := pr.CreatedAt
+	if opened.IsZero() {
+		opened = time.Now().UTC()
+	}
+	r := s.repo(name)
+	r.PR = &prState{
+		Number:   pr.Number,
+		URL:      pr.URL,
+		Rule:     trailers[trailerRule],
+		Campaign: trailers[trailerCampaign],
+		HeadSHA:  pr.HeadSHA,
+		BaseSHA:  pr.BaseSHA,
+		Checks:   checkPending,
+		State:    "open",
+		OpenedAt: opened,
+		Diff:     diff,
+	}
+	r.UpdatedAt = time.Now().UTC()
+	return s.save()
+}
+
+// recordChecks stores the latest check results for the PR against name.
+func (s *stateStore) recordChecks(name, headSHA string, checks checkState, brokeBuild bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.repo(name)
+	if r.PR == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	r.PR.HeadSHA = headSHA
+	r.PR.Checks = checks
+	r.PR.BrokeBuild = brokeBuild
+	r.PR.CheckedAt = now
+	r.UpdatedAt = now
+	return s.save()
+}
+
+// recordPRState stores the state a PR was seen in and reports whether it
+// changed.
+func (s *stateStore) recordPRState(name, prState string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.repo(name)
+	if r.PR == nil || r.PR.State == prState {
+		return false, nil
+	}
+	now := time.Now().UTC()
+	r.PR.State = prState
+	if prState != "open" && r.PR.ClosedAt.IsZero() {
+		r.PR.ClosedAt = now
+	}
+	r.UpdatedAt = now
+	return true, s.save()
+}
+
+// recordPROutcome stores the state of pr as the forge reports it, with the
+// times it was opened and closed.
+func (s *stateStore) recordPROutcome(name string, pr *forgePR) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.repo(name)
+	if r.PR == nil {
+		return nil
+	}
+	r.PR.State = prOutcome(pr)
+	if !pr.CreatedAt.IsZero() {
+		r.PR.OpenedAt = pr.CreatedAt
+	}
+	if !pr.ClosedAt.IsZero() {
+		r.PR.ClosedAt = pr.ClosedAt
+	}
+	r.UpdatedAt = time.Now().UTC()
+	return s.save()
+}
+
+// recordCloseReason stores why the PR against name was closed.
+func (s *stateStore) recordCloseReason(name, reason, comment string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := s.repo(name)
+	if r.PR == nil {
+		return nil
+	}
+	r.PR.CloseReason = reason
+	r.PR.CloseComment = comment
+	r.UpdatedAt = time.Now().UTC()
+	return s.save()
+}
+
+// prOutcome returns "open", "merged" or "closed" for pr.
+func prOutcome(pr *forgePR) string {
+	switch {
+	case pr.Merged:
+		return "merged"
+	case pr.State != "open":
+		return "closed"
+	}
+	return "open"
+}
+
+// notePRState records whether pr is still open and counts it the first
+// time it is seen merged or closed. It reports whether pr is still open.
+func notePRState(st *stateStore, name string, pr *forgePR) bool {
+	current := prOutcome(pr)
+	changed, err := st.recordPRState(name, current)
+	if err != nil {
+		logrus.Warnf("saving PR state for %s failed: %v", name, err)
+	}
+	if changed && current != "open" {
+		pullRequests.inc(current)
+	}
+	return current == "open"
+}
+
+// pendingPRs returns the repos whose PR checks have not settled yet.
+func (s *stateStore) pendingPRs() map[string]prState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prs := map[string]prState{}
+	for name, r := range s.Repos {
+		if r.PR != nil && r.PR.Checks == checkPending {
+			prs[name] = *r.PR
+		}
+	}
+	return prs
+}
+
+// claCheck matches the names CLA bots report under, like cla/google,
+// license/cla, EasyCLA or CLA Assistant.
+var claCheck = regexp.MustCompile(`(?i)(^|[^a-z])(easy)?cla([^a-z]|$)`)
+
+// combineChecks sums up the checks of a commit. Any failure fails the
+// commit, unless all failures come from CLA bots. A commit nothing reports
+// on yet is pending, since CI may not have picked it up.
+func combineChecks(checks []commitCheck) checkState {
+	if len(checks) == 0 {
+		return checkPending
+	}
+	result := checkSuccess
+	cla := false
+	for _, c := range checks {
+		switch c.State {
+		case checkFailure:
+			if !claCheck.MatchString(c.Name) {
+				return checkFailure
+			}
+			cla = true
+		case checkPending:
+			result = checkPending
+		}
+	}
+	if cla {
+		return checkBlockedOnCLA
+	}
+	return result
+}
+
+// watchChecks polls the checks on the head of pr until they settle and
+// records the outcome. The first look is a poll interval after the PR was
+// opened, to give CI time to pick it up, and a PR nothing has reported
+// checks on by ciTimeout is recorded as having none. A failing PR is
+// compared against its base commit to tell whether the change broke the
+// build.
+func watchChecks(ctx context.Context, f forge, st *stateStore, upstream *forgeRepo, pr *forgePR, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	name := upstream.FullName()
+	headSHA := pr.HeadSHA
+	reported := false
+	deadline := time.Now().Add(ciTimeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ciPollInterval):
+		}
+
+		current, err := f.GetPR(ctx, upstream, pr.Number)
+		switch {
+		case err != nil:
+			logrus.Warnf("checking %s failed: %v", pr.URL, err)
+		case !notePRState(st, name, current):
+			return
+		default:
+			headSHA = current.HeadSHA
+			result, n, err := prChecks(ctx, f, upstream, current)
+			if err != nil {
+				logrus.Warnf("getting checks of %s failed: %v", pr.URL, err)
+				break
+			}
+			reported = n > 0
+			if result != checkPending {
+				recordCheckResult(ctx, f, st, upstream, current, result)
+				return
+			}
+		}
+
+		if time.Now().After(deadline) {
+			if reported {
+				logrus.Warnf("checks on %s still pending after %s", pr.URL, ciTimeout)
+				return
+			}
+			logrus.Warnf("nothing reported checks on %s within %s", pr.URL, ciTimeout)
+			audit.record(auditEvent{Event: eventChecks, Repo: name, SHA: headSHA, URL: pr.URL, Reason: string(checkNone)})
+			if err := st.recordChecks(name, headSHA, checkNone, false); err != nil {
+				logrus.Warnf("saving checks of %s failed: %v", pr.URL, err)
+			}
+			return
+		}
+	}
+}
+
+// recordCheckResult records the settled checks of pr, and whether the change
+// broke the build if they failed.
+func recordCheckResult(ctx context.Context, f forge, st *stateStore, upstream *forgeRepo, pr *forgePR, result checkState) {
+	name := upstream.FullName()
+	brokeBuild := false
+	if result == checkFailure {
+		brokeBuild = baseWasGreen(ctx, f, upstream, pr)
+	}
+	audit.record(auditEvent{Event: eventChecks, Repo: name, SHA: pr.HeadSHA, URL: pr.URL, Reason: string(result)})
+	if err := st.recordChecks(name, pr.HeadSHA, result, brokeBuild); err != nil {
+		logrus.Warnf("saving checks of %s failed: %v", pr.URL, err)
+	}
+	if brokeBuild {
+		logrus.Warnf("%s fails checks that pass on %s, the change broke the build", pr.URL, upstream.DefaultBranch)
+	} else {
+		logrus.Infof("Checks on %s: %s", pr.URL, result)
+	}
+}
+
+// prChecks returns the combined checks of the head of pr and how many
+// checks were reported.
+func prChecks(ctx context.Context, f forge, repo *forgeRepo, pr *forgePR) (checkState, int, error) {
+	var checks []commitCheck
+	_, err := retry(ctx, stageChecks, func() error {
+		var err error
+		checks, err = f.CommitChecks(ctx, repo, pr.HeadSHA)
+		return err
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return combineChecks(checks), len(checks), nil
+}
+
+// baseWasGreen reports whether the commit pr is based on had checks and
+// they all passed. A base nothing reports on tells us nothing.
+func baseWasGreen(ctx context.Context, f forge, repo *forgeRepo, pr *forgePR) bool {
+	if pr.BaseSHA == "" {
+		return false
+	}
+	var checks []commitCheck
+	_, err := retry(ctx, stageChecks, func() error {
+		var err error
+		checks, err = f.CommitChecks(ctx, repo, pr.BaseSHA)
+		return err
+	})
+	if err != nil {
+		logrus.Debugf("getting checks of %s base %s failed: %v", pr.URL, pr.BaseSHA, err)
+		return false
+	}
+	return len(checks) > 0 && combineChecks(checks) == checkSuccess
+}
+
+// resumeChecks starts watching the PRs whose checks were still pending when
+// the bot last stopped.
+func resumeChecks(ctx context.Context, f forge, st *stateStore, wg *sync.WaitGroup) {
+	for name, pr := range st.pendingPRs() {
+		repo, err := getRepo(ctx, f, name)
+		if err != nil {
+			logrus.Warnf("resuming checks of %s failed: %v", pr.URL, err)
+			continue
+		}
+		wg.Add(1)
+		go watchChecks(ctx, f, st, repo, &forgePR{Number: pr.Number, URL: pr.URL}, wg)
+	}
+}
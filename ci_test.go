@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCombineChecks(t *testing.T) {
+	testCases := []struct {
+		name   string
+		checks []commitCheck
+		want   checkState
+	}{
+		{"nothing reported", nil, checkPending},
+		{"all green", []commitCheck{{"travis", checkSuccess}, {"lint", checkSuccess}}, checkSuccess},
+		{"one pending", []commitCheck{{"travis", checkSuccess}, {"lint", checkPending}}, checkPending},
+		{"one failed", []commitCheck{{"travis", checkPending}, {"lint", checkFailure}}, checkFailure},
+		{"only the CLA failed", []commitCheck{{"travis", checkSuccess}, {"cla/google", checkFailure}}, checkBlockedOnCLA},
+		{"CLA and build failed", []commitCheck{{"cla/google", checkFailure}, {"travis", checkFailure}}, checkFailure},
+		{"CLA failed while the build runs", []commitCheck{{"license/cla", checkFailure}, {"travis", checkPending}}, checkBlockedOnCLA},
+	}
+
+	for _, tc := range testCases {
+		if got := combineChecks(tc.checks); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCLACheck(t *testing.T) {
+	testCases := []struct {
+		name string
+		want bool
+	}{
+		{"cla/google", true},
+		{"license/cla", true},
+		{"EasyCLA", true},
+		{"CLA Assistant", true},
+		{"cla", true},
+		{"continuous-integration/travis-ci", false},
+		{"clang-tidy", false},
+		{"declarative", false},
+	}
+
+	for _, tc := range testCases {
+		if got := claCheck.MatchString(tc.name); got != tc.want {
+			t.Errorf("%q: got %t, want %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+// checksForge reports fixed checks per commit. Every other forge method
+// panics.
+type checksForge struct {
+	forge
+	checks map[string][]commitCheck
+}
+
+func (f *checksForge) CommitChecks(ctx context.Context, repo *forgeRepo, sha string) ([]commitCheck, error) {
+	return f.checks[sha], nil
+}
+
+func TestBaseWasGreen(t *testing.T) {
+	f := &checksForge{checks: map[string][]commitCheck{
+		"green":   {{"travis", checkSuccess}},
+		"red":     {{"travis", checkFailure}},
+		"pending": {{"travis", checkPending}},
+	}}
+	testCases := []struct {
+		base string
+		want bool
+	}{
+		{"green", true},
+		{"red", false},
+		{"pending", false},
+		// a base nothing reports on tells us nothing
+		{"unreported", false},
+		{"", false},
+	}
+
+	for _, tc := range testCases {
+		pr := &forgePR{URL: "https://example.com/pr/1", BaseSHA: tc.base}
+		if got := baseWasGreen(context.Background(), f, &forgeRepo{}, pr); got != tc.want {
+			t.Errorf("base %q: got %t, want %t", tc.base, got, tc.want)
+		}
+	}
+}
+
+func TestPRChecks(t *testing.T) {
+	f := &checksForge{checks: map[string][]commitCheck{
+		"head": {{"travis", checkSuccess}, {"lint", checkSuccess}},
+	}}
+	testCases := []struct {
+		head  string
+		want  checkState
+		wantN int
+	}{
+		{"head", checkSuccess, 2},
+		{"unreported", checkPending, 0},
+	}
+
+	for _, tc := range testCases {
+		got, n, err := prChecks(context.Background(), f, &forgeRepo{}, &forgePR{HeadSHA: tc.head})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want || n != tc.wantN {
+			t.Errorf("head %q: got %s with %d checks, want %s with %d", tc.head, got, n, tc.want, tc.wantN)
+		}
+	}
+}
+
+func TestPendingPRs(t *testing.T) {
+	st := &stateStore{Repos: map[string]*repoState{
+		"a/pending": {PR: &prState{Number: 1, Checks: checkPending}},
+		"a/green":   {PR: &prState{Number: 2, Checks: checkSuccess}},
+		"a/none":    {PR: &prState{Number: 3, Checks: checkNone}},
+		"a/no-pr":   {},
+	}}
+
+	prs := st.pendingPRs()
+	if len(prs) != 1 || prs["a/pending"].Number != 1 {
+		t.Errorf("got %v, want only a/pending", prs)
+	}
+}
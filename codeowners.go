@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"path"
+	"strings"
+)
+
+// codeownersPaths are the places GitHub looks for a CODEOWNERS file, in
+// order.
+var codeownersPaths = []string{".github/CODEOWNERS", "CODEOWNERS", "docs/CODEOWNERS"}
+
+// codeownersRule is a single pattern line of a CODEOWNERS file.
+type codeownersRule struct {
+	pattern string
+	owners  []string
+}
+
+// parseCodeowners parses the content of a CODEOWNERS file.
+func parseCodeowners(content string) []codeownersRule {
+	var rules []codeownersRule
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		rules = append(rules, codeownersRule{pattern: fields[0], owners: fields[1:]})
+	}
+	return rules
+}
+
+// match reports whether the pattern matches file, following the gitignore
+// style rules CODEOWNERS uses.
+func (r codeownersRule) match(file string) bool {
+	pattern := r.pattern
+	anchored := strings.HasPrefix(pattern, "/") || strings.Contains(strings.TrimSuffix(pattern, "/"), "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	if strings.HasSuffix(pattern, "/") {
+		// A directory owns everything below it.
+		pattern += "**"
+	}
+
+	if !anchored {
+		// An unanchored pattern can match at any depth.
+		pattern = "**/" + pattern
+	}
+	return globMatch(strings.Split(pattern, "/"), strings.Split(file, "/"))
+}
+
+// globMatch matches path segments against pattern segments where "**"
+// matches any number of segments.
+func globMatch(pattern, segments []string) bool {
+	last := ""
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(segments); i++ {
+				if globMatch(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		last = pattern[0]
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	// A pattern naming a directory also owns the files inside it, but
+	// "docs/*" only owns the files directly in docs.
+	return len(segments) == 0 || last != "*"
+}
+
+// ownersFor returns the owners of file. The last matching rule wins.
+func ownersFor(rules []codeownersRule, file string) []string {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].match(file) {
+			return rules[i].owners
+		}
+	}
+	return nil
+}
+
+// codeownersReviewers reads the CODEOWNERS file of repo at ref and returns
+// the users and teams that own any of files. Email owners and the bot
+// itself are left out since they cannot be requested as reviewers.
+func codeownersReviewers(ctx context.Context, f forge, repo *forgeRepo, ref string, files []string) (users, teams []string) {
+	var rules []codeownersRule
+	for _, p := range codeownersPaths {
+		file, err := f.ReadFile(ctx, repo, p, ref)
+		if err == nil {
+			rules = parseCodeowners(file.Content)
+			break
+		}
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+
+	seen := map[string]bool{}
+	for _, file := range files {
+		for _, owner := range ownersFor(rules, file) {
+			if !strings.HasPrefix(owner, "@") || seen[owner] {
+				continue
+			}
+			seen[owner] = true
+
+			name := strings.TrimPrefix(owner, "@")
+			if i := strings.Index(name, "/"); i >= 0 {
+				// @org/team
+				teams = append(teams, name[i+1:])
+				continue
+			}
+			if !strings.EqualFold(name, botLogin) {
+				users = append(users, name)
+			}
+		}
+	}
+	return users, teams
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestCodeownersRuleMatch(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		file    string
+		want    bool
+	}{
+		{"*", "main.go", true},
+		{"*", "cmd/app/main.go", true},
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/app/main.go", true},
+		{"*.go", "README.md", false},
+		{".travis.yml", ".travis.yml", true},
+		{".travis.yml", "sub/.travis.yml", true},
+		{"/.travis.yml", "sub/.travis.yml", false},
+		{"/docs/", "docs/a/b.md", true},
+		{"/docs/", "src/docs/a.md", false},
+		{"apps/", "apps/a.go", true},
+		{"apps/", "src/apps/a.go", true},
+		{"docs/*", "docs/a.md", true},
+		{"docs/*", "docs/a/b.md", false},
+		{"docs/**", "docs/a/b.md", true},
+		{"**/logs", "build/logs/today.log", true},
+		{"**/logs", "logs/today.log", true},
+		{"/build/logs/", "build/logs/today.log", true},
+		{"/build/logs/", "build/logger.go", false},
+		{"src/app", "src/app/main.go", true},
+		{"src/app", "other/src/app/main.go", false},
+	}
+
+	for _, tc := range testCases {
+		if got := (codeownersRule{pattern: tc.pattern}).match(tc.file); got != tc.want {
+			t.Errorf("%q against %q: got %t, want %t", tc.pattern, tc.file, got, tc.want)
+		}
+	}
+}
+
+func TestOwnersFor(t *testing.T) {
+	rules := parseCodeowners(`
+# everyone owns everything
+*       @org/everyone
+
+*.yml   @ci-owner
+/docs/  @docs-owner docs@example.com
+`)
+	testCases := []struct {
+		file string
+		want []string
+	}{
+		{"main.go", []string{"@org/everyone"}},
+		{".travis.yml", []string{"@ci-owner"}},
+		{"docs/index.md", []string{"@docs-owner", "docs@example.com"}},
+		// the last matching rule wins
+		{"docs/config.yml", []string{"@docs-owner", "docs@example.com"}},
+	}
+
+	for _, tc := range testCases {
+		if got := ownersFor(rules, tc.file); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.file, got, tc.want)
+		}
+	}
+}
+
+// filesForge serves fixed file contents. Every other forge method panics.
+type filesForge struct {
+	forge
+	files map[string]string
+}
+
+func (f *filesForge) ReadFile(ctx context.Context, repo *forgeRepo, path, ref string) (*forgeFile, error) {
+	content, ok := f.files[path]
+	if !ok {
+		return nil, errNotFound
+	}
+	return &forgeFile{Path: path, Content: content}, nil
+}
+
+func TestCodeownersReviewers(t *testing.T) {
+	defer func(login string) { botLogin = login }(botLogin)
+	botLogin = "fixer-bot"
+
+	testCases := []struct {
+		name      string
+		files     map[string]string
+		changed   []string
+		wantUsers []string
+		wantTeams []string
+	}{
+		{
+			name:  "no CODEOWNERS",
+			files: map[string]string{},
+		},
+		{
+			name:      "users and teams, without emails or the bot",
+			files:     map[string]string{".github/CODEOWNERS": "* @alice @org/core alice@example.com @Fixer-Bot\n"},
+			changed:   []string{".travis.yml"},
+			wantUsers: []string{"alice"},
+			wantTeams: []string{"core"},
+		},
+		{
+			name: "the first CODEOWNERS found is used",
+			files: map[string]string{
+				".github/CODEOWNERS": "*.yml @ci\n",
+				"CODEOWNERS":         "* @root\n",
+			},
+			changed:   []string{".travis.yml", "Makefile"},
+			wantUsers: []string{"ci"},
+		},
+		{
+			name:      "owners are not repeated",
+			files:     map[string]string{"docs/CODEOWNERS": "* @alice\n"},
+			changed:   []string{".travis.yml", "Makefile"},
+			wantUsers: []string{"alice"},
+		},
+	}
+
+	for _, tc := range testCases {
+		users, teams := codeownersReviewers(context.Background(), &filesForge{files: tc.files}, &forgeRepo{}, "", tc.changed)
+		if !reflect.DeepEqual(users, tc.wantUsers) || !reflect.DeepEqual(teams, tc.wantTeams) {
+			t.Errorf("%s: got users %v and teams %v, want %v and %v", tc.name, users, teams, tc.wantUsers, tc.wantTeams)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// prTemplatePaths are the places forges look for a pull request template,
+// in order.
+var prTemplatePaths = []string{
+	".github/PULL_REQUEST_TEMPLATE.md",
+	".github/pull_request_template.md",
+	"PULL_REQUEST_TEMPLATE.md",
+	"pull_request_template.md",
+	"docs/PULL_REQUEST_TEMPLATE.md",
+	"docs/pull_request_template.md",
+	".gitea/pull_request_template.md",
+	".gitlab/merge_request_templates/Default.md",
+}
+
+// historyDepth is how many recent commits the commit style is inferred from.
+const historyDepth = 30
+
+// conventionalSubject matches a Conventional Commits subject like
+// "chore(deps)!: bump x".
+var conventionalSubject = regexp.MustCompile(`^([a-z]+)(\(([^)]+)\))?!?: (.+)$`)
+
+// markdownHeading matches a Markdown ATX heading.
+var markdownHeading = regexp.MustCompile(`^#{1,6}\s+(.*?)\s*#*\s*$`)
+
+// htmlComment matches the hints templates leave for PR authors.
+var htmlComment = regexp.MustCompile(`(?s)<!--.*?-->`)
+
+// followConventions adapts msg to repo: the body is poured into the repo's
+// PR template and the commit subject follows the style of recent commits.
+// Anything that can't be read leaves msg as it is.
+func followConventions(ctx context.Context, f forge, repo *forgeRepo, r *rule, msg *prMessage) {
+	for _, p := range prTemplatePaths {
+		file, err := f.ReadFile(ctx, repo, p, "")
+		if err != nil {
+			continue
+		}
+		logrus.Debugf("filling in %s of %s", p, repo.FullName())
+		msg.Body = fillPRTemplate(file.Content, r, msg.Body)
+		break
+	}
+
+	commits, err := f.Commits(ctx, repo, repo.DefaultBranch, historyDepth)
+	if err != nil {
+		logrus.Debugf("reading commit history of %s failed: %v", repo.FullName(), err)
+		return
+	}
+	var messages []string
+	for _, c := range commits {
+		messages = append(messages, c.Message)
+	}
+	msg.Commit = conventionalCommit(messages, r.CommitType, msg.Commit)
+}
+
+// fillPRTemplate fills the sections of a PR template we know how to answer
+// and leaves the rest as they are. Text before the first heading is kept
+// unless the template has no headings at all, in which case body is put
+// above it.
+func fillPRTemplate(template string, r *rule, body string) string {
+	lines := strings.Split(strings.Replace(template, "\r\n", "\n", -1), "\n")
+
+	var (
+		out    []string
+		filled bool
+		skip   bool
+	)
+	for _, line := range lines {
+		if heading := headingText(line); heading != "" {
+			out = append(out, line)
+			skip = false
+			if answer := sectionAnswer(heading, r, body); answer != "" {
+				out = append(out, "", answer, "")
+				filled = true
+				skip = true
+			}
+			continue
+		}
+		if skip {
+			continue
+		}
+		out = append(out, line)
+	}
+
+	if !filled {
+		// Nothing we recognize, so say our piece on top.
+		return body + "\n\n" + strings.TrimSpace(template)
+	}
+	return strings.TrimSpace(strings.Join(out, "\n"))
+}
+
+func headingText(line string) string {
+	m := markdownHeading.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// sectionAnswer returns what goes under a template section with the given
+// heading, or "" if it is not one we know.
+func sectionAnswer(heading string, r *rule, body string) string {
+	h := strings.ToLower(htmlComment.ReplaceAllString(heading, ""))
+	has := func(words ...string) bool {
+		for _, w := range words {
+			if strings.Contains(h, w) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has("motivation", "why", "rationale", "reason", "context", "background"):
+		return r.Rationale
+	case has("related", "link", "reference", "issue"):
+		if len(r.Links) == 0 {
+			return ""
+		}
+		return "- " + strings.Join(r.Links, "\n- ")
+	case has("description", "summary", "what", "change", "overview", "details", "proposed"):
+		return body
+	}
+	return ""
+}
+
+// conventionalCommit rewrites the subject of message to the Conventional
+// Commits style when most of the history uses it. commitType is used if
+// the repo ever used it, otherwise "chore". The scope and the case of the
+// description follow what the history does most of the time.
+func conventionalCommit(history []string, commitType, message string) string {
+	var (
+		matched, scoped, lower int
+		types                  = map[string]bool{}
+		scopes                 = map[string]int{}
+	)
+	for _, m := range history {
+		subject := strings.SplitN(m, "\n", 2)[0]
+		c := conventionalSubject.FindStringSubmatch(subject)
+		if c == nil {
+			continue
+		}
+		matched++
+		types[c[1]] = true
+		if c[3] != "" {
+			scoped++
+			scopes[c[1]+"("+c[3]+")"]++
+		}
+		if r, _ := utf8.DecodeRuneInString(c[4]); unicode.IsLower(r) {
+			lower++
+		}
+	}
+	if len(history) == 0 || matched*2 < len(history) {
+		return message
+	}
+
+	typ := commitType
+	if typ == "" || !types[typ] {
+		typ = "chore"
+	}
+	prefix := typ
+	if scoped*2 > matched {
+		// use the scope the repo most often uses with our type
+		best := 0
+		for s, n := range scopes {
+			if strings.HasPrefix(s, typ+"(") && n > best {
+				prefix, best = s, n
+			}
+		}
+	}
+
+	parts := strings.SplitN(message, "\n", 2)
+	subject := parts[0]
+	if lower*2 > matched {
+		r, size := utf8.DecodeRuneInString(subject)
+		subject = string(unicode.ToLower(r)) + subject[size:]
+	}
+	parts[0] = prefix + ": " + subject
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,111 @@
+package main
+
+import "testing"
+
+func TestConventionalCommit(t *testing.T) {
+	message := "Fix golint import path\n\nThe old path no longer builds."
+	testCases := []struct {
+		name       string
+		history    []string
+		commitType string
+		want       string
+	}{
+		{
+			name: "no history",
+			want: message,
+		},
+		{
+			name:       "history mostly without conventional subjects",
+			history:    []string{"Fix the build", "Update README", "feat: add a flag"},
+			commitType: "ci",
+			want:       message,
+		},
+		{
+			name:       "type the repo uses, lower case descriptions",
+			history:    []string{"feat: add a flag\n\nwith a body", "fix: handle nil", "ci: bump go"},
+			commitType: "ci",
+			want:       "ci: fix golint import path\n\nThe old path no longer builds.",
+		},
+		{
+			name:       "type the repo never used falls back to chore",
+			history:    []string{"feat: Add a flag", "fix: Handle nil"},
+			commitType: "ci",
+			want:       "chore: Fix golint import path\n\nThe old path no longer builds.",
+		},
+		{
+			name:       "scope the repo uses with the type",
+			history:    []string{"ci(travis): bump go", "ci(travis): add lint", "ci(gh): cache", "feat(api): add"},
+			commitType: "ci",
+			want:       "ci(travis): fix golint import path\n\nThe old path no longer builds.",
+		},
+		{
+			name:    "scoped history without a scope for the type",
+			history: []string{"feat(api): add", "fix(db)!: drop table"},
+			want:    "chore: fix golint import path\n\nThe old path no longer builds.",
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := conventionalCommit(tc.history, tc.commitType, message); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestFillPRTemplate(t *testing.T) {
+	r := &rule{Rationale: "The old path no longer builds.", Links: []string{"https://a.example", "https://b.example"}}
+	body := "This moves golint."
+	testCases := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "known sections are answered, others kept",
+			template: "## Description\n\n<!-- What does this change? -->\n\n## Why\n\n\n## Checklist\n\n- [ ] tests\n",
+			want:     "## Description\n\nThis moves golint.\n\n## Why\n\nThe old path no longer builds.\n\n## Checklist\n\n- [ ] tests",
+		},
+		{
+			name:     "links and commented headings",
+			template: "### Summary <!-- required -->\r\nDescribe it\r\n### Related issues\r\nFixes #\r\n",
+			want:     "### Summary <!-- required -->\n\nThis moves golint.\n\n### Related issues\n\n- https://a.example\n- https://b.example",
+		},
+		{
+			name:     "no headings",
+			template: "Please sign the CLA.\n",
+			want:     "This moves golint.\n\nPlease sign the CLA.",
+		},
+		{
+			name:     "no heading we know",
+			template: "## Checklist\n- [ ] done\n",
+			want:     "This moves golint.\n\n## Checklist\n- [ ] done",
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := fillPRTemplate(tc.template, r, body); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSectionAnswer(t *testing.T) {
+	testCases := []struct {
+		heading string
+		r       *rule
+		want    string
+	}{
+		{"Motivation and Context", &rule{Rationale: "because"}, "because"},
+		{"Why", &rule{}, ""},
+		{"Related Issue", &rule{Links: []string{"https://a.example"}}, "- https://a.example"},
+		{"Related Issue", &rule{}, ""},
+		{"Proposed changes", &rule{}, "body"},
+		{"Screenshots", &rule{Rationale: "because"}, ""},
+	}
+
+	for _, tc := range testCases {
+		if got := sectionAnswer(tc.heading, tc.r, "body"); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.heading, got, tc.want)
+		}
+	}
+}
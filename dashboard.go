@@ -0,0 +1,422 @@
+package main
+
+import (
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// recentEventCount is how many audit events the dashboard keeps.
+const recentEventCount = 200
+
+// eventRing keeps the latest audit events in memory for the dashboard.
+type eventRing struct {
+	mu     sync.Mutex
+	events []auditEvent
+	next   int
+}
+
+var recentEvents = &eventRing{}
+
+func (r *eventRing) add(e auditEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.events) < recentEventCount {
+		r.events = append(r.events, e)
+	} else {
+		r.events[r.next] = e
+	}
+	r.next = (r.next + 1) % recentEventCount
+}
+
+// latest returns the events kept, newest first, only those about repo if it
+// is not empty.
+func (r *eventRing) latest(repo string) []auditEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var events []auditEvent
+	for i := range r.events {
+		e := r.events[(r.next-1-i+2*len(r.events))%len(r.events)]
+		if repo == "" || e.Repo == repo {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// rateBudget is the rate limit a forge last reported for a kind of API
+// call.
+type rateBudget struct {
+	Resource  string
+	Limit     int
+	Remaining int
+	Reset     time.Time
+	SeenAt    time.Time
+}
+
+// rateBudgets tracks the rate limits reported in API responses.
+type rateBudgets struct {
+	mu      sync.Mutex
+	budgets map[string]*rateBudget
+}
+
+var rateLimits = &rateBudgets{budgets: map[string]*rateBudget{}}
+
+// observe picks up the rate limit headers of GitHub (X-RateLimit-*) and
+// GitLab (RateLimit-*). Responses without them are ignored.
+func (b *rateBudgets) observe(h http.Header) {
+	prefix := "X-RateLimit-"
+	if h.Get(prefix+"Limit") == "" {
+		prefix = "RateLimit-"
+	}
+	limit, err := strconv.Atoi(h.Get(prefix + "Limit"))
+	if err != nil {
+		return
+	}
+	remaining, _ := strconv.Atoi(h.Get(prefix + "Remaining"))
+	budget := &rateBudget{
+		Resource:  h.Get("X-RateLimit-Resource"),
+		Limit:     limit,
+		Remaining: remaining,
+		SeenAt:    time.Now().UTC(),
+	}
+	if budget.Resource == "" {
+		budget.Resource = "core"
+	}
+	if reset, err := strconv.ParseInt(h.Get(prefix+"Reset"), 10, 64); err == nil {
+		budget.Reset = time.Unix(reset, 0).UTC()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.budgets[budget.Resource] = budget
+}
+
+func (b *rateBudgets) list() []rateBudget {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var list []rateBudget
+	for _, budget := range b.budgets {
+		list = append(list, *budget)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Resource < list[j].Resource })
+	return list
+}
+
+// pipelineStages are the stages a repo can be at, in pipeline order.
+var pipelineStages = []string{
+	stageSearch, stageContent, stageDuplicate, stageUpstreamCheck, stageFork, stageForkReady,
+	stageSync, stageBranch, stageCommit, stagePullRequest, stageChecks, stageMerge, stageSkipped,
+}
+
+// stageCount is the number of repos at a stage, and how many of them
+// failed there.
+type stageCount struct {
+	Stage  string
+	Repos  int
+	Failed int
+}
+
+// campaignView is what the dashboard shows about a campaign.
+type campaignView struct {
+	Name      string
+	Status    string
+	Source    string
+	Rules     []string
+	RateShare int
+	Stages    []stageCount
+	Open      int
+	Merged    int
+	Closed    int
+	Failed    int
+}
+
+func viewCampaign(c *campaign) campaignView {
+	v := campaignView{Name: c.Name, Status: c.Status(), Source: c.src.Name(), RateShare: c.rateShare}
+	for _, r := range c.rules {
+		v.Rules = append(v.Rules, r.ref())
+	}
+
+	c.state.mu.Lock()
+	stages := map[string]*stageCount{}
+	for _, rs := range c.state.Repos {
+		sc, ok := stages[rs.Stage]
+		if !ok {
+			sc = &stageCount{Stage: rs.Stage}
+			stages[rs.Stage] = sc
+		}
+		sc.Repos++
+		if rs.Failure != "" {
+			sc.Failed++
+		}
+		if rs.PR != nil {
+			switch rs.PR.State {
+			case "merged":
+				v.Merged++
+			case "closed":
+				v.Closed++
+			default:
+				v.Open++
+			}
+		}
+	}
+	v.Failed = len(c.state.DeadLetters)
+	c.state.mu.Unlock()
+
+	for _, sc := range stages {
+		v.Stages = append(v.Stages, *sc)
+	}
+	less := orderOf(pipelineStages)
+	sort.Slice(v.Stages, func(i, j int) bool { return less(v.Stages[i].Stage, v.Stages[j].Stage) })
+	return v
+}
+
+// lookup returns a copy of what s knows about name.
+func (s *stateStore) lookup(name string) (repoState, *deadLetter, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.Repos[name]
+	if !ok {
+		return repoState{}, nil, false
+	}
+	c := *r
+	if r.PR != nil {
+		pr := *r.PR
+		c.PR = &pr
+	}
+	return c, s.DeadLetters[name], true
+}
+
+// dashboard serves a view of the campaigns and their state, and queues
+// failed repos to be retried for those who give the admin token.
+type dashboard struct {
+	token string
+}
+
+// serveDashboard serves the dashboard on addr until the process exits.
+// Without a token failed repos can't be retried from it.
+func serveDashboard(addr, token string) {
+	d := &dashboard{token: token}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.index)
+	mux.HandleFunc("/repos/", d.repo)
+	mux.HandleFunc("/failed", d.failed)
+	mux.HandleFunc("/failed/retry", d.retry)
+	logrus.Infof("Serving the dashboard on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("dashboard server failed: %v", err)
+	}
+}
+
+func (d *dashboard) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	var views []campaignView
+	for _, c := range campaigns {
+		views = append(views, viewCampaign(c))
+	}
+	events := recentEvents.latest("")
+	if len(events) > 50 {
+		events = events[:50]
+	}
+	d.render(w, "index", map[string]interface{}{
+		"Campaigns":  views,
+		"RateLimits": rateLimits.list(),
+		"Events":     events,
+	})
+}
+
+func (d *dashboard) repo(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/repos/")
+	if _, _, err := splitRepoName(name); err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	type repoView struct {
+		Campaign   string
+		State      repoState
+		DeadLetter *deadLetter
+	}
+	var views []repoView
+	for _, c := range campaigns {
+		if rs, dl, ok := c.state.lookup(name); ok {
+			views = append(views, repoView{Campaign: c.Name, State: rs, DeadLetter: dl})
+		}
+	}
+	d.render(w, "repo", map[string]interface{}{
+		"Repo":      name,
+		"Campaigns": views,
+		"Events":    recentEvents.latest(name),
+	})
+}
+
+func (d *dashboard) failed(w http.ResponseWriter, r *http.Request) {
+	type queue struct {
+		Campaign string
+		Letters  []*deadLetter
+	}
+	var queues []queue
+	for _, c := range campaigns {
+		queues = append(queues, queue{Campaign: c.Name, Letters: deadLetters(c.state, "")})
+	}
+	queued, _ := strconv.Atoi(r.FormValue("queued"))
+	d.render(w, "failed", map[string]interface{}{
+		"Queues":   queues,
+		"CanRetry": d.token != "",
+		"Queued":   queued,
+	})
+}
+
+// retry queues the failed repo given, or every failed repo of the campaign
+// if none is. The admin token has to be given with the form, which also
+// keeps other sites from posting it.
+func (d *dashboard) retry(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "retry with a POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if d.token == "" {
+		http.Error(w, "retrying needs -admin-token to be set", http.StatusForbidden)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.PostFormValue("token")), []byte(d.token)) != 1 {
+		http.Error(w, "missing or wrong admin token", http.StatusUnauthorized)
+		return
+	}
+	c := findCampaign(r.PostFormValue("campaign"))
+	if c == nil {
+		http.Error(w, "no such campaign", http.StatusNotFound)
+		return
+	}
+	queued := queueFailed(c, r.PostFormValue("repo"))
+	if len(queued) == 0 {
+		http.Error(w, "nothing to retry", http.StatusNotFound)
+		return
+	}
+	logrus.Infof("Queued %d failed repositories from the dashboard", len(queued))
+	http.Redirect(w, r, "/failed?queued="+strconv.Itoa(len(queued)), http.StatusSeeOther)
+}
+
+func (d *dashboard) render(w http.ResponseWriter, page string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplates.ExecuteTemplate(w, page, data); err != nil {
+		logrus.Warnf("rendering the %s page failed: %v", page, err)
+	}
+}
+
+var dashboardFuncs = map[string]interface{}{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+}
+
+var dashboardTemplates = template.Must(template.New("dashboard").Funcs(dashboardFuncs).Parse(`
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.}} - golint-fixer</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: .3em .6em; text-align: left; }
+td.n { text-align: right; }
+pre { background: #f6f8fa; padding: 1em; }
+form { margin-bottom: 1em; }
+</style>
+</head>
+<body>
+<p><a href="/">Campaigns</a> | <a href="/failed">Failed</a></p>
+{{end}}
+
+{{define "footer"}}</body>
+</html>
+{{end}}
+
+{{define "events"}}<table>
+<tr><th>Time</th><th>Event</th><th>Repo</th><th>Stage</th><th>Detail</th></tr>
+{{range .}}<tr><td>{{time .Time}}</td><td>{{.Event}}</td><td>{{if .Repo}}<a href="/repos/{{.Repo}}">{{.Repo}}</a>{{end}}</td><td>{{.Stage}}</td><td>{{.Reason}} {{.Detail}} {{.Error}}{{if .URL}} <a href="{{.URL}}">{{.URL}}</a>{{end}}{{if .Count}} {{.Count}}{{end}}</td></tr>
+{{else}}<tr><td colspan="5">Nothing happened yet.</td></tr>
+{{end}}</table>
+{{end}}
+
+{{define "index"}}{{template "header" "Campaigns"}}
+<meta http-equiv="refresh" content="30">
+<h1>Campaigns</h1>
+{{range .Campaigns}}
+<h2>{{or .Name "default"}} ({{.Status}})</h2>
+<p>Repositories from {{.Source}}, rules {{range $i, $r := .Rules}}{{if $i}}, {{end}}{{$r}}{{end}}, rate share {{.RateShare}}.</p>
+<p>PRs open {{.Open}}, merged {{.Merged}}, closed {{.Closed}}. <a href="/failed">{{.Failed}} failed</a>.</p>
+<table>
+<tr><th>Stage</th><th>Repos</th><th>Failed there</th></tr>
+{{range .Stages}}<tr><td>{{.Stage}}</td><td class="n">{{.Repos}}</td><td class="n">{{.Failed}}</td></tr>
+{{else}}<tr><td colspan="3">No repos yet.</td></tr>
+{{end}}</table>
+{{end}}
+<h2>Rate limits</h2>
+<table>
+<tr><th>Resource</th><th>Remaining</th><th>Limit</th><th>Resets</th><th>Seen</th></tr>
+{{range .RateLimits}}<tr><td>{{.Resource}}</td><td class="n">{{.Remaining}}</td><td class="n">{{.Limit}}</td><td>{{time .Reset}}</td><td>{{time .SeenAt}}</td></tr>
+{{else}}<tr><td colspan="5">No rate limits reported yet.</td></tr>
+{{end}}</table>
+<h2>Recent events</h2>
+{{template "events" .Events}}
+{{template "footer"}}{{end}}
+
+{{define "repo"}}{{template "header" .Repo}}
+<h1>{{.Repo}}</h1>
+{{range .Campaigns}}
+<h2>Campaign {{or .Campaign "default"}}</h2>
+{{with .State}}<table>
+<tr><th>Stage</th><td>{{.Stage}}</td></tr>
+{{if .Skipped}}<tr><th>Skipped</th><td>{{.Skipped}}</td></tr>{{end}}
+{{if .Failure}}<tr><th>Failure</th><td>{{.Failure}} ({{.Class}}, {{.Attempts}} attempt(s))</td></tr>{{end}}
+<tr><th>Updated</th><td>{{time .UpdatedAt}}</td></tr>
+{{with .PR}}<tr><th>PR</th><td><a href="{{.URL}}">#{{.Number}}</a> {{.State}}, rule {{.Rule}}</td></tr>
+<tr><th>Checks</th><td>{{.Checks}}{{if .BrokeBuild}}, likely broken by the fix{{end}}</td></tr>
+<tr><th>Opened</th><td>{{time .OpenedAt}}</td></tr>
+{{if not .ClosedAt.IsZero}}<tr><th>Closed</th><td>{{time .ClosedAt}}</td></tr>{{end}}
+{{if .CloseReason}}<tr><th>Close reason</th><td>{{.CloseReason}}: {{.CloseComment}}</td></tr>{{end}}{{end}}
+</table>
+{{with .PR}}{{if .Diff}}<pre>{{.Diff}}</pre>{{end}}{{end}}{{end}}
+{{with .DeadLetter}}<p>Failed at {{.Stage}} at {{time .FailedAt}}, <a href="/failed">retry it from the failed repositories</a>.</p>{{end}}
+{{else}}<p>No campaign has processed this repository.</p>
+{{end}}
+<h2>Recent events</h2>
+{{template "events" .Events}}
+{{template "footer"}}{{end}}
+
+{{define "failed"}}{{template "header" "Failed"}}
+<h1>Failed repositories</h1>
+{{if .Queued}}<p>Queued {{.Queued}} repositories to be retried.</p>{{end}}
+{{if not .CanRetry}}<p>Set <code>-admin-token</code> to retry them from here.</p>{{end}}
+{{$canRetry := .CanRetry}}
+{{range .Queues}}
+<h2>Campaign {{or .Campaign "default"}}</h2>
+{{if .Letters}}{{if $canRetry}}<form method="post" action="/failed/retry">
+<input type="hidden" name="campaign" value="{{.Campaign}}">
+<label>Admin token <input type="password" name="token" required></label>
+<button name="repo" value="">Retry all</button>{{end}}
+<table>
+<tr><th>Repo</th><th>Stage</th><th>Status</th><th>Attempts</th><th>Failed at</th><th>Error</th>{{if $canRetry}}<th></th>{{end}}</tr>
+{{range .Letters}}<tr><td><a href="/repos/{{.Repo}}">{{.Repo}}</a></td><td>{{.Stage}}</td><td class="n">{{.Status}}</td><td class="n">{{.Attempts}}</td><td>{{time .FailedAt}}</td><td>{{.Error}}</td>{{if $canRetry}}<td><button name="repo" value="{{.Repo}}">Retry</button></td>{{end}}</tr>
+{{end}}</table>
+{{if $canRetry}}</form>{{end}}
+{{else}}<p>No failed repositories.</p>{{end}}
+{{end}}
+{{template "footer"}}{{end}}
+`))
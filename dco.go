@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// contributingPaths are the places a CONTRIBUTING guide is looked for.
+var contributingPaths = []string{"CONTRIBUTING.md", ".github/CONTRIBUTING.md", "docs/CONTRIBUTING.md", "CONTRIBUTING"}
+
+// dcoText matches CONTRIBUTING guides that ask for a sign-off.
+var dcoText = regexp.MustCompile(`(?i)signed-off-by|developer certificate of origin|\bDCO\b|git commit -s\b|--signoff`)
+
+// commitAuthor returns the identity set with -author-name and
+// -author-email, or nil to let the forge decide.
+func commitAuthor() *commitIdentity {
+	if authorEmail == "" {
+		return nil
+	}
+	name := authorName
+	if name == "" {
+		name = botLogin
+	}
+	return &commitIdentity{Name: name, Email: authorEmail}
+}
+
+// commitCommitter returns the identity set with -committer-name and
+// -committer-email, falling back to the author.
+func commitCommitter() *commitIdentity {
+	if committerEmail == "" {
+		return commitAuthor()
+	}
+	name := committerName
+	if name == "" {
+		name = botLogin
+	}
+	return &commitIdentity{Name: name, Email: committerEmail}
+}
+
+// requiresDCO reports whether repo wants commits signed off, going by a DCO
+// app config, DCO checks on the default branch or the CONTRIBUTING guide.
+func requiresDCO(ctx context.Context, f forge, repo *forgeRepo) (bool, string) {
+	if _, err := f.ReadFile(ctx, repo, ".github/dco.yml", ""); err == nil {
+		return true, ".github/dco.yml"
+	}
+
+	checks, err := f.CommitChecks(ctx, repo, repo.DefaultBranch)
+	if err == nil {
+		for _, c := range checks {
+			if strings.Contains(strings.ToLower(c.Name), "dco") {
+				return true, "the " + c.Name + " check"
+			}
+		}
+	}
+
+	for _, p := range contributingPaths {
+		file, err := f.ReadFile(ctx, repo, p, "")
+		if err != nil {
+			continue
+		}
+		if dcoText.MatchString(file.Content) {
+			return true, p
+		}
+		break
+	}
+	return false, ""
+}
+
+// signOff adds a Signed-off-by trailer for the commit author to msg if repo
+// requires one.
+func signOff(ctx context.Context, f forge, repo *forgeRepo, msg *prMessage) {
+	required, reason := requiresDCO(ctx, f, repo)
+	if !required {
+		return
+	}
+	author := commitAuthor()
+	if author == nil {
+		logrus.Warnf("%s requires a DCO sign-off (%s) but -author-email is not set", repo.FullName(), reason)
+		return
+	}
+	logrus.Debugf("signing off commit to %s as required by %s", repo.FullName(), reason)
+	msg.Commit = addTrailer(msg.Commit, "Signed-off-by", author.Name+" <"+author.Email+">")
+}
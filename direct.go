@@ -0,0 +1,24 @@
+package main
+
+// directBranchPrefix starts the name of the branch the fix is pushed to
+// when the bot can push to the upstream repo itself.
+const directBranchPrefix = "golint-fixer/"
+
+// fixTarget is where the fix for an upstream repo is committed: the bot's
+// fork, or a branch in upstream itself in direct-branch mode.
+type fixTarget struct {
+	upstream *forgeRepo
+	head     *forgeRepo
+	branch   string
+	// rule is the rule the fix comes from.
+	rule *rule
+	// planned maps the files an applied plan changes to the blob SHAs they
+	// had when it was made, see planTarget. The fix is refused if they
+	// differ now.
+	planned map[string]string
+}
+
+// direct reports whether the fix lives in a branch of upstream.
+func (t *fixTarget) direct() bool {
+	return t.head.ID == t.upstream.ID
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+const explainHelp = `Trace every decision the pipeline would make for a repository.
+
+Runs the discovery filters, eligibility checks, rule matching and duplicate
+checks without changing anything, and prints each decision with its reason.`
+
+func (cmd *explainCommand) Name() string      { return "explain" }
+func (cmd *explainCommand) Args() string      { return "owner/repo" }
+func (cmd *explainCommand) ShortHelp() string { return "Explain why a repo would get a PR or not." }
+func (cmd *explainCommand) LongHelp() string  { return explainHelp }
+func (cmd *explainCommand) Hidden() bool      { return false }
+
+func (cmd *explainCommand) Register(fs *flag.FlagSet) {}
+
+type explainCommand struct{}
+
+// explanation collects the decisions made about a repo. The first failing
+// decision is the one that stops the pipeline.
+type explanation struct {
+	w       *tabwriter.Writer
+	blocked string
+}
+
+func (e *explanation) pass(step, format string, args ...interface{}) {
+	fmt.Fprintf(e.w, "ok\t%s\t%s\n", step, fmt.Sprintf(format, args...))
+}
+
+func (e *explanation) fail(step, format string, args ...interface{}) {
+	reason := fmt.Sprintf(format, args...)
+	fmt.Fprintf(e.w, "STOP\t%s\t%s\n", step, reason)
+	if e.blocked == "" {
+		e.blocked = step + ": " + reason
+	}
+}
+
+func (e *explanation) info(step, format string, args ...interface{}) {
+	fmt.Fprintf(e.w, "-\t%s\t%s\n", step, fmt.Sprintf(format, args...))
+}
+
+func (cmd *explainCommand) Run(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("pass the repository to explain as owner/repo")
+	}
+
+	f, err := connectForge(ctx)
+	if err != nil {
+		return err
+	}
+	return explain(ctx, f, args[0], os.Stdout)
+}
+
+// explain walks repo through the pipeline read-only and writes each
+// decision to out.
+func explain(ctx context.Context, f forge, name string, out io.Writer) error {
+	c, err := currentCampaign()
+	if err != nil {
+		return err
+	}
+	e := &explanation{w: tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)}
+	fmt.Fprintf(e.w, "\tSTEP\tDECISION\n")
+
+	repo, err := getRepo(ctx, f, name)
+	if err != nil {
+		e.fail("lookup", "getting %s from %s failed: %v", name, f.Name(), err)
+		return e.w.Flush()
+	}
+	e.pass("lookup", "%s, default branch %s, fork %t, archived %t, push access %t", repo.HTMLURL, repo.DefaultBranch, repo.Fork, repo.Archived, repo.CanPush)
+	explainState(e, c.state, repo.FullName())
+
+	// discovery
+	if c.Name != "" {
+		e.info("campaign", "explaining campaign %s", c.Name)
+	}
+	e.info("discovery", "repositories come from %s", c.src.Name())
+	if _, ok := c.src.(*ownerSource); ok && repo.Fork {
+		e.fail("discovery", "forks are skipped when listing an owner's repositories")
+	}
+	if kind, reason := c.policy.allowsRepo(repo); kind != "" {
+		e.fail("policy", "%s", reason)
+	}
+	if state.denied(repo.Owner) {
+		e.fail("denylist", "%s is on the denylist", repo.Owner)
+	}
+
+	// eligibility and rule matching, first matching rule wins
+	var r *rule
+	files := map[string]*forgeFile{}
+	for _, cand := range c.rules {
+		file, ok := files[cand.Path]
+		if !ok {
+			file, err = getFileContent(ctx, f, repo, cand.Path, "")
+			if err != nil {
+				e.info("rule "+cand.ref(), "reading %s failed: %v", cand.Path, err)
+			} else {
+				e.info("file", "%s is %d bytes at blob %s", file.Path, len(file.Content), file.SHA)
+			}
+			files[cand.Path] = file
+		}
+		switch {
+		case file == nil:
+		case !cand.matches(file.Content):
+			e.info("rule "+cand.ref(), "%s does not contain %s", cand.Path, cand.Old)
+		case r != nil:
+			e.info("rule "+cand.ref(), "matches too, but only %s is applied", r.ref())
+		default:
+			if fixed, changed := cand.apply(file.Content); !changed {
+				e.fail("rule "+cand.ref(), "applying the rule changes nothing")
+			} else {
+				e.pass("rule "+cand.ref(), "would rewrite %s to %s: %s", cand.Old, cand.New, diffStat([]fileChange{newFileChange(file.Path, file.Content, fixed)}))
+			}
+			r = cand
+		}
+	}
+	if r == nil {
+		e.fail("rules", "none of the %d rule(s) match", len(c.rules))
+		r = c.rules[0]
+	}
+	if travis := files[".travis.yml"]; travis != nil {
+		explainGoVersions(e, c.policy, travis.Content)
+	}
+
+	if repo.Archived {
+		e.fail("archived", "the repository is archived and read-only")
+	} else {
+		e.pass("archived", "the repository is not archived")
+	}
+
+	// duplicate checks, the same heads hasBotPullRequest looks at
+	var heads []string
+	for _, cand := range c.rules {
+		heads = append(heads, botLogin+":"+c.forkBranch(cand, repo), repo.Owner+":"+c.directBranch(cand))
+	}
+	found := false
+	for _, head := range heads {
+		prs, err := f.ListPRs(ctx, repo, head)
+		if err != nil {
+			e.fail("duplicates", "listing PRs from %s failed: %v", head, err)
+			continue
+		}
+		for _, pr := range prs {
+			found = true
+			e.fail("duplicates", "PR #%d from %s is %s: %s", pr.Number, head, pr.State, pr.URL)
+		}
+	}
+	if !found {
+		e.pass("duplicates", "no PRs from %s", strings.Join(heads, " or "))
+	}
+
+	// where the fix would be committed
+	if repo.CanPush {
+		e.info("target", "would push branch %s to the repository itself", c.directBranch(r))
+	} else if rec, ok := state.lookupFork(repo.ID); ok {
+		e.info("target", "would reuse fork %s, branch %s", rec.ForkName, c.forkBranch(r, repo))
+	} else {
+		e.info("target", "would fork the repository as %s", botLogin)
+	}
+	if r.autoMerges(repo.Owner) {
+		e.info("auto-merge", "%s is on the auto-merge allowlist of %s", repo.Owner, r.Name)
+	}
+
+	if e.blocked != "" {
+		fmt.Fprintf(e.w, "\nverdict\tno PR\t%s\n", e.blocked)
+	} else {
+		fmt.Fprintf(e.w, "\nverdict\tPR\tthe bot would open a PR\n")
+	}
+	return e.w.Flush()
+}
+
+// explainState prints what st remembers about name.
+func explainState(e *explanation, st *stateStore, name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	rs, ok := st.Repos[name]
+	if !ok {
+		e.info("state", "never processed")
+		return
+	}
+	switch {
+	case rs.Failure != "":
+		e.info("state", "failed at %s after %d attempt(s) on %s: %s", rs.Stage, rs.Attempts, rs.UpdatedAt.Format("2006-01-02"), rs.Failure)
+	case rs.Skipped != "":
+		e.info("state", "skipped on %s: %s", rs.UpdatedAt.Format("2006-01-02"), rs.Skipped)
+	default:
+		e.info("state", "reached %s on %s", rs.Stage, rs.UpdatedAt.Format("2006-01-02"))
+	}
+	if rs.PR != nil {
+		e.info("state", "PR %s is %s, checks %s", rs.PR.URL, rs.PR.State, rs.PR.Checks)
+	}
+}
+
+// explainGoVersions prints the Go versions the Travis file builds with and
+// whether policy allows them.
+func explainGoVersions(e *explanation, policy eligibilityPolicy, content string) {
+	travis := Travis{}
+	if err := yaml.Unmarshal([]byte(content), &travis); err != nil {
+		e.info("go versions", "parsing the Travis file failed: %v", err)
+		return
+	}
+	if len(travis.GoVersions) == 0 {
+		e.info("go versions", "none listed")
+		return
+	}
+	versions := strings.Join(travis.GoVersions, ", ")
+	switch {
+	case policy.minGo == nil:
+		e.info("go versions", "%s, no minimum set by the policy", versions)
+	case policy.allowsGoVersions(content):
+		e.pass("go versions", "%s, all at least %s", versions, policy.MinGoVersion)
+	default:
+		e.fail("go versions", "%s, some older than %s", versions, policy.MinGoVersion)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const failedHelp = `Inspect and re-drive repositories that failed in the pipeline.
+
+  failed list                  list the dead-letter queue
+  failed retry [-stage <name>] re-drive failed repositories through the pipeline`
+
+func (cmd *failedCommand) Name() string      { return "failed" }
+func (cmd *failedCommand) Args() string      { return "list | retry [-stage <name>]" }
+func (cmd *failedCommand) ShortHelp() string { return "Inspect and re-drive failed repositories." }
+func (cmd *failedCommand) LongHelp() string  { return failedHelp }
+func (cmd *failedCommand) Hidden() bool      { return false }
+
+func (cmd *failedCommand) Register(fs *flag.FlagSet) {}
+
+type failedCommand struct{}
+
+// deadLetter is a repository that failed in the pipeline and is waiting to
+// be retried.
+type deadLetter struct {
+	Repo     string    `json:"repo"`
+	Stage    string    `json:"stage"`
+	Error    string    `json:"error"`
+	Status   int       `json:"status,omitempty"`
+	Attempts int       `json:"attempts,omitempty"`
+	FailedAt time.Time `json:"failed_at"`
+}
+
+func (cmd *failedCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("must pass a subcommand: list or retry")
+	}
+
+	switch args[0] {
+	case "list":
+		return cmd.list()
+	case "retry":
+		fs := flag.NewFlagSet("retry", flag.ExitOnError)
+		stage := fs.String("stage", "", "only retry repositories that failed at this stage")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return cmd.retry(ctx, *stage)
+	}
+	return fmt.Errorf("%s: no such subcommand, must be list or retry", args[0])
+}
+
+func (cmd *failedCommand) list() error {
+	c, err := currentCampaign()
+	if err != nil {
+		return err
+	}
+	letters := deadLetters(c.state, "")
+	if len(letters) == 0 {
+		fmt.Println("No failed repositories.")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "REPO\tSTAGE\tSTATUS\tATTEMPTS\tFAILED AT\tERROR")
+	for _, dl := range letters {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n", dl.Repo, dl.Stage, dl.Status, dl.Attempts, dl.FailedAt.Format(time.RFC3339), dl.Error)
+	}
+	return w.Flush()
+}
+
+func (cmd *failedCommand) retry(ctx context.Context, stage string) error {
+	if stage != "" {
+		if _, ok := retryPolicies[stage]; !ok {
+			return fmt.Errorf("unknown stage %q", stage)
+		}
+	}
+
+	c, err := currentCampaign()
+	if err != nil {
+		return err
+	}
+	letters := deadLetters(c.state, stage)
+	if len(letters) == 0 {
+		logrus.Info("Nothing to retry.")
+		return nil
+	}
+
+	f, err := connectForge(ctx)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Retrying %d failed repositories.", len(letters))
+	runPipeline(ctx, f, c, func(targets chan<- *fixTarget, wg *sync.WaitGroup) {
+		redriveDeadLetters(ctx, f, c, letters, targets, wg)
+	})
+	return nil
+}
+
+// deadLetters returns the dead-letter queue sorted by failure time,
+// optionally limited to a single stage.
+func deadLetters(st *stateStore, stage string) []*deadLetter {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	var letters []*deadLetter
+	for _, dl := range st.DeadLetters {
+		if stage == "" || dl.Stage == stage {
+			letters = append(letters, dl)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FailedAt.Before(letters[j].FailedAt)
+	})
+	return letters
+}
+
+// queueFailed queues the failed repo given, or every failed repo of c if
+// repo is empty, and returns the repos it queued. Queued repos are retried
+// one at a time by the queue of c.
+func queueFailed(c *campaign, repo string) []string {
+	var queued []string
+	for _, dl := range deadLetters(c.state, "") {
+		if repo != "" && dl.Repo != repo {
+			continue
+		}
+		if state.denied(strings.SplitN(dl.Repo, "/", 2)[0]) {
+			continue
+		}
+		if c.enqueue(dl.Repo) {
+			queued = append(queued, dl.Repo)
+		}
+	}
+	return queued
+}
+
+// redriveDeadLetters looks up the upstream repository of every dead letter
+// and, if it is still eligible, sends it back into the pipeline of c.
+func redriveDeadLetters(ctx context.Context, f forge, c *campaign, letters []*deadLetter, targets chan<- *fixTarget, wg *sync.WaitGroup) {
+	defer close(targets)
+	defer wg.Done()
+
+	for _, dl := range letters {
+		repo, attempts, err := fetchRepo(ctx, f, dl.Repo)
+		if err != nil {
+			c.recordFailure(dl.Repo, dl.Stage, attempts, err)
+			continue
+		}
+
+		// Policy, denylist and rules may have changed since it failed.
+		r, kind, reason, err := checkEligible(ctx, f, c, repo)
+		if err != nil {
+			stage, attempts, err := errorStage(err, stageDuplicate)
+			c.recordFailure(dl.Repo, stage, attempts, err)
+			continue
+		}
+		if kind == "has-pr" {
+			logrus.Infof("%s already has a PR, dropping it from the queue", dl.Repo)
+			if err := c.state.recordStage(dl.Repo, stagePullRequest); err != nil {
+				logrus.Warnf("saving state for %s failed: %v", dl.Repo, err)
+			}
+			continue
+		}
+		if r == nil {
+			c.recordSkip(dl.Repo, kind, reason)
+			continue
+		}
+		targets <- &fixTarget{upstream: repo, rule: r}
+		logrus.Debugf("sent %s to be retried", dl.Repo)
+	}
+}
+
+// splitRepoName splits "owner/name" into its parts. The owner may contain
+// slashes itself, as GitLab subgroups do.
+func splitRepoName(s string) (string, string, error) {
+	s = strings.TrimSpace(s)
+	i := strings.LastIndex(s, "/")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("%q is not in the form owner/name", s)
+	}
+	return s[:i], s[i+1:], nil
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// forgeRepo is a repository on any forge.
+type forgeRepo struct {
+	ID            int64
+	Owner         string
+	Name          string
+	DefaultBranch string
+	HTMLURL       string
+	Archived      bool
+	Fork          bool
+	Stars         int
+	// PushedAt is when the repository last saw a push, or any activity
+	// on forges that don't track pushes.
+	PushedAt time.Time
+	// CanPush is set when the bot may push branches to the repository.
+	CanPush bool
+	// Parent is the repository this one was forked from, if any.
+	Parent *forgeRepo
+}
+
+// FullName returns the repository as owner/name.
+func (r *forgeRepo) FullName() string {
+	return r.Owner + "/" + r.Name
+}
+
+// forgeFile is a file read from a repository.
+type forgeFile struct {
+	Path    string
+	SHA     string
+	Content string
+}
+
+// forgePR is a pull request, or merge request on GitLab.
+type forgePR struct {
+	Number int
+	URL    string
+	// State is "open" or "closed", or "merged" on GitLab.
+	State   string
+	HeadSHA string
+	// BaseSHA is the commit on the base branch the PR was opened against.
+	BaseSHA string
+	Merged  bool
+	// Mergeable is set when the forge would let the PR be merged now: no
+	// conflicts, and required reviews and branch protections are met.
+	Mergeable bool
+	CreatedAt time.Time
+	// ClosedAt is when the PR was merged or closed, zero while it is open.
+	ClosedAt time.Time
+}
+
+// forgeComment is a comment on the conversation of an issue or pull
+// request.
+type forgeComment struct {
+	ID int64
+	// Issue is the number of the issue commented on. Only IssueComments
+	// sets it.
+	Issue     int
+	Author    string
+	Body      string
+	CreatedAt time.Time
+}
+
+// checkState is the outcome of a CI status or check run, or of all of them
+// for a commit.
+type checkState string
+
+const (
+	checkPending checkState = "pending"
+	checkSuccess checkState = "success"
+	checkFailure checkState = "failure"
+	// checkBlockedOnCLA is a commit whose only failures come from a CLA
+	// bot.
+	checkBlockedOnCLA checkState = "blocked-on-cla"
+	// checkNone is a PR nothing reported checks on before we stopped
+	// watching it.
+	checkNone checkState = "none"
+)
+
+// commitCheck is a single status or check run reported for a commit.
+type commitCheck struct {
+	Name  string
+	State checkState
+}
+
+// forgeCommit is a commit read from a repository.
+type forgeCommit struct {
+	SHA     string
+	Message string
+}
+
+// commitIdentity is the name and email of a commit author or committer.
+type commitIdentity struct {
+	Name  string
+	Email string
+}
+
+// newCommit holds what is needed to commit a file. A nil Author or
+// Committer leaves it to the forge, which uses the authenticated user.
+type newCommit struct {
+	Message   string
+	Author    *commitIdentity
+	Committer *commitIdentity
+}
+
+// newPullRequest holds what is needed to open a pull request from a fork.
+type newPullRequest struct {
+	Title string
+	Body  string
+	// Head is the branch in the fork, Base the branch in upstream.
+	Head string
+	Base string
+}
+
+// forge is the set of operations the pipeline needs from a code hosting
+// service.
+type forge interface {
+	// Name of the forge for logging.
+	Name() string
+	// User returns the login of the authenticated user.
+	User(ctx context.Context) (string, error)
+
+	// Search calls found for every repository with code matching query
+	// until the results run out or found returns false.
+	Search(ctx context.Context, query string, page int, found func(*forgeRepo) bool) error
+	// ListRepos calls found for every source repository of a user or
+	// organization until they run out or found returns false.
+	ListRepos(ctx context.Context, owner string, found func(*forgeRepo) bool) error
+	// GetRepo fetches a single repository.
+	GetRepo(ctx context.Context, owner, name string) (*forgeRepo, error)
+
+	// Fork returns the bot's fork of upstream, creating it if needed. The
+	// fork is ready to be committed to when Fork returns. Forks are found
+	// again by ID, so renames do not lose them. Only GitHub forks are
+	// synced with upstream, the others are used as they are, with a
+	// warning when they lag behind.
+	Fork(ctx context.Context, upstream *forgeRepo) (*forgeRepo, error)
+	// ReadFile reads path from repo at ref. An empty ref reads the default
+	// branch.
+	ReadFile(ctx context.Context, repo *forgeRepo, path, ref string) (*forgeFile, error)
+	// Commits returns the last n commits on ref, newest first.
+	Commits(ctx context.Context, repo *forgeRepo, ref string, n int) ([]*forgeCommit, error)
+	// CommitFile replaces the content of file on branch and returns the
+	// new commit's SHA.
+	CommitFile(ctx context.Context, repo *forgeRepo, branch string, file *forgeFile, content string, commit *newCommit) (string, error)
+
+	// CreateBranch points branch in repo at the head of the default
+	// branch, creating it or resetting it as needed.
+	CreateBranch(ctx context.Context, repo *forgeRepo, branch string) error
+
+	// OpenPR opens a pull request from fork against upstream. fork is the
+	// same as upstream when the branch lives in upstream itself.
+	OpenPR(ctx context.Context, upstream, fork *forgeRepo, pr *newPullRequest) (*forgePR, error)
+	// RequestReviewers asks users and teams to review pr.
+	RequestReviewers(ctx context.Context, repo *forgeRepo, pr *forgePR, users, teams []string) error
+	// ListPRs lists the pull requests in any state against repo whose head
+	// is the given owner:branch.
+	ListPRs(ctx context.Context, repo *forgeRepo, head string) ([]*forgePR, error)
+	// GetPR fetches the current state of a pull request.
+	GetPR(ctx context.Context, repo *forgeRepo, number int) (*forgePR, error)
+	// Comments lists the comments on the conversation of an issue or pull
+	// request, oldest first.
+	Comments(ctx context.Context, repo *forgeRepo, number int) ([]*forgeComment, error)
+	// IssueComments lists the comments made on any issue of repo since the
+	// given time, oldest first.
+	IssueComments(ctx context.Context, repo *forgeRepo, since time.Time) ([]*forgeComment, error)
+	// CreateComment comments on an issue or pull request.
+	CreateComment(ctx context.Context, repo *forgeRepo, number int, body string) error
+	// IsTeamMember reports whether user belongs to team, given as org/team
+	// on GitHub and Gitea and as a group path on GitLab.
+	IsTeamMember(ctx context.Context, team, user string) (bool, error)
+
+	// CommitChecks lists the statuses and check runs reported for sha.
+	CommitChecks(ctx context.Context, repo *forgeRepo, sha string) ([]commitCheck, error)
+	// EnableAutoMerge asks the forge to merge pr by itself once it is
+	// ready. It fails if the repo does not allow that. Some forges merge
+	// right away when no checks are reported, so only call it after some
+	// are.
+	EnableAutoMerge(ctx context.Context, repo *forgeRepo, pr *forgePR) error
+	// MergePR merges pr, as long as its head is still pr.HeadSHA.
+	MergePR(ctx context.Context, repo *forgeRepo, pr *forgePR) error
+}
+
+// newForge creates the forge selected with the -forge flag.
+func newForge(ctx context.Context) (forge, error) {
+	if signingKey != "" && forgeType != "" && forgeType != "github" {
+		return nil, fmt.Errorf("-signing-key is only supported on github")
+	}
+
+	switch forgeType {
+	case "", "github":
+		client, err := newGitHubClient(ctx)
+		if err != nil {
+			return nil, err
+		}
+		gh := &githubForge{client: client}
+		if signingKey != "" {
+			gh.signer, err = loadSigner(signingKey, signingFormat)
+			if err != nil {
+				return nil, fmt.Errorf("loading signing key %s failed: %v", signingKey, err)
+			}
+		}
+		return gh, nil
+	case "gitea", "forgejo":
+		if enturl == "" {
+			return nil, fmt.Errorf("-url is required for %s", forgeType)
+		}
+		return newGiteaForge(enturl, token)
+	case "gitlab":
+		u := enturl
+		if u == "" {
+			u = "https://gitlab.com/api/v4/"
+		}
+		return newGitLabForge(u, token)
+	}
+	return nil, fmt.Errorf("unknown forge %q, must be github, gitea, forgejo or gitlab", forgeType)
+}
+
+// stageError records the pipeline stage an error happened in, and the
+// attempts made at it, when a single forge call covers several stages.
+type stageError struct {
+	stage    string
+	attempts int
+	err      error
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+// errorStage returns the stage and attempts recorded in err, or fallback
+// and a single attempt.
+func errorStage(err error, fallback string) (string, int, error) {
+	if e, ok := err.(*stageError); ok {
+		return e.stage, e.attempts, e.err
+	}
+	return fallback, 1, err
+}
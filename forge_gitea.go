@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// giteaForge talks to the Gitea (and Forgejo) v1 API.
+type giteaForge struct {
+	api *restClient
+
+	mu sync.Mutex
+	// login is the bot's login, looked up once.
+	login string
+}
+
+func newGiteaForge(baseURL, token string) (*giteaForge, error) {
+	api, err := newRESTClient(baseURL, "Authorization", "token "+token)
+	if err != nil {
+		return nil, err
+	}
+	return &giteaForge{api: api}, nil
+}
+
+type giteaRepo struct {
+	ID            int64      `json:"id"`
+	Name          string     `json:"name"`
+	Owner         giteaUser  `json:"owner"`
+	DefaultBranch string     `json:"default_branch"`
+	HTMLURL       string     `json:"html_url"`
+	Archived      bool       `json:"archived"`
+	Fork          bool       `json:"fork"`
+	Stars         int        `json:"stars_count"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	Parent        *giteaRepo `json:"parent"`
+	Permissions   struct {
+		Push bool `json:"push"`
+	} `json:"permissions"`
+}
+
+type giteaUser struct {
+	Login string `json:"login"`
+}
+
+type giteaPR struct {
+	Number    int        `json:"number"`
+	HTMLURL   string     `json:"html_url"`
+	State     string     `json:"state"`
+	Merged    bool       `json:"merged"`
+	Mergeable bool       `json:"mergeable"`
+	Created   time.Time  `json:"created_at"`
+	Closed    *time.Time `json:"closed_at"`
+	MergedAt  *time.Time `json:"merged_at"`
+	Head      struct {
+		Ref  string    `json:"ref"`
+		SHA  string    `json:"sha"`
+		Repo giteaRepo `json:"repo"`
+	} `json:"head"`
+	Base struct {
+		SHA string `json:"sha"`
+	} `json:"base"`
+}
+
+func (pr *giteaPR) forgePR() *forgePR {
+	p := &forgePR{
+		Number:    pr.Number,
+		URL:       pr.HTMLURL,
+		State:     pr.State,
+		HeadSHA:   pr.Head.SHA,
+		BaseSHA:   pr.Base.SHA,
+		Merged:    pr.Merged,
+		Mergeable: pr.Mergeable,
+		CreatedAt: pr.Created,
+	}
+	switch {
+	case pr.MergedAt != nil:
+		p.ClosedAt = *pr.MergedAt
+	case pr.Closed != nil:
+		p.ClosedAt = *pr.Closed
+	}
+	return p
+}
+
+func (r *giteaRepo) forgeRepo() *forgeRepo {
+	if r == nil {
+		return nil
+	}
+	return &forgeRepo{
+		ID:            r.ID,
+		Owner:         r.Owner.Login,
+		Name:          r.Name,
+		DefaultBranch: r.DefaultBranch,
+		HTMLURL:       r.HTMLURL,
+		Archived:      r.Archived,
+		Fork:          r.Fork,
+		Stars:         r.Stars,
+		PushedAt:      r.UpdatedAt,
+		CanPush:       r.Permissions.Push,
+		Parent:        r.Parent.forgeRepo(),
+	}
+}
+
+func (f *giteaForge) Name() string { return "gitea" }
+
+func (f *giteaForge) User(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.login != "" {
+		return f.login, nil
+	}
+
+	var u giteaUser
+	if _, err := f.api.do(ctx, "GET", "user", nil, &u); err != nil {
+		return "", err
+	}
+	f.login = u.Login
+	return u.Login, nil
+}
+
+func (f *giteaForge) Search(ctx context.Context, query string, page int, found func(*forgeRepo) bool) error {
+	return fmt.Errorf("gitea has no code search API, use -repo, -repos-file or -owner instead")
+}
+
+func (f *giteaForge) ListRepos(ctx context.Context, owner string, found func(*forgeRepo) bool) error {
+	// Organizations and users have separate endpoints; try the
+	// organization first.
+	base := fmt.Sprintf("orgs/%s/repos", url.PathEscape(owner))
+	if _, err := f.api.do(ctx, "GET", fmt.Sprintf("orgs/%s", url.PathEscape(owner)), nil, nil); err != nil {
+		if e, ok := err.(*httpError); !ok || e.StatusCode != http.StatusNotFound {
+			return err
+		}
+		base = fmt.Sprintf("users/%s/repos", url.PathEscape(owner))
+	}
+
+	const limit = 50
+	for page := 1; ; page++ {
+		var repos []*giteaRepo
+		_, err := retry(ctx, stageSearch, func() error {
+			_, err := f.api.do(ctx, "GET", fmt.Sprintf("%s?page=%d&limit=%d", base, page, limit), nil, &repos)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("listing repositories of %s failed: %v", owner, err)
+		}
+
+		for _, repo := range repos {
+			if repo.Fork {
+				continue
+			}
+			if !found(repo.forgeRepo()) {
+				return nil
+			}
+		}
+		if len(repos) < limit {
+			return nil
+		}
+	}
+}
+
+func (f *giteaForge) GetRepo(ctx context.Context, owner, name string) (*forgeRepo, error) {
+	var repo giteaRepo
+	if _, err := f.api.do(ctx, "GET", giteaRepoPath(owner, name), nil, &repo); err != nil {
+		return nil, err
+	}
+	return repo.forgeRepo(), nil
+}
+
+func (f *giteaForge) Fork(ctx context.Context, upstream *forgeRepo) (*forgeRepo, error) {
+	// reuse a fork we made before, wherever it lives now
+	fork, attempts, err := resolveForgeFork(ctx, upstream, func(id int64) (*forgeRepo, error) {
+		var repo giteaRepo
+		if _, err := f.api.do(ctx, "GET", fmt.Sprintf("repositories/%d", id), nil, &repo); err != nil {
+			return nil, err
+		}
+		return repo.forgeRepo(), nil
+	})
+	if err != nil {
+		return nil, &stageError{stageFork, attempts, err}
+	}
+	if fork == nil {
+		if fork, err = f.newFork(ctx, upstream); err != nil {
+			return nil, err
+		}
+	}
+	if err := state.registerFork(upstream, fork); err != nil {
+		logrus.Warnf("saving fork of %s failed: %v", upstream.FullName(), err)
+	}
+
+	warnStaleFork(ctx, f, upstream, fork)
+	return fork, nil
+}
+
+// newFork forks upstream, or finds the fork under the name of upstream.
+func (f *giteaForge) newFork(ctx context.Context, upstream *forgeRepo) (*forgeRepo, error) {
+	// Gitea creates forks synchronously and returns 409 if we already
+	// have one.
+	var fork giteaRepo
+	attempts, err := retry(ctx, stageFork, func() error {
+		_, err := f.api.do(ctx, "POST", giteaRepoPath(upstream.Owner, upstream.Name)+"/forks", struct{}{}, &fork)
+		return err
+	})
+	if e, ok := err.(*httpError); ok && e.StatusCode == http.StatusConflict {
+		login, err := f.User(ctx)
+		if err != nil {
+			return nil, &stageError{stageFork, 1, err}
+		}
+		existing, err := f.GetRepo(ctx, login, upstream.Name)
+		if err != nil {
+			return nil, &stageError{stageFork, 1, err}
+		}
+		if existing.Parent == nil || existing.Parent.ID != upstream.ID {
+			return nil, &stageError{stageFork, 1, fmt.Errorf("%s is not a fork of %s", existing.FullName(), upstream.FullName())}
+		}
+		return existing, nil
+	}
+	if err != nil {
+		return nil, &stageError{stageFork, attempts, err}
+	}
+
+	repo := fork.forgeRepo()
+	if repo.Parent == nil {
+		repo.Parent = upstream
+	}
+	return repo, nil
+}
+
+func (f *giteaForge) ReadFile(ctx context.Context, repo *forgeRepo, path, ref string) (*forgeFile, error) {
+	var file struct {
+		Path     string `json:"path"`
+		SHA      string `json:"sha"`
+		Content  string `json:"content"`
+		Encoding string `json:"encoding"`
+	}
+	u := fmt.Sprintf("%s/contents/%s", giteaRepoPath(repo.Owner, repo.Name), escapePath(path))
+	if ref != "" {
+		u += "?ref=" + url.QueryEscape(ref)
+	}
+	if _, err := f.api.do(ctx, "GET", u, nil, &file); err != nil {
+		return nil, err
+	}
+
+	content := file.Content
+	if file.Encoding == "base64" {
+		b, err := base64.StdEncoding.DecodeString(content)
+		if err != nil {
+			return nil, fmt.Errorf("unable to get file content: %v", err)
+		}
+		content = string(b)
+	}
+	return &forgeFile{Path: file.Path, SHA: file.SHA, Content: content}, nil
+}
+
+func (f *giteaForge) Commits(ctx context.Context, repo *forgeRepo, ref string, n int) ([]*forgeCommit, error) {
+	var commits []struct {
+		SHA    string `json:"sha"`
+		Commit struct {
+			Message string `json:"message"`
+		} `json:"commit"`
+	}
+	u := fmt.Sprintf("%s/commits?sha=%s&limit=%d&stat=false", giteaRepoPath(repo.Owner, repo.Name), url.QueryEscape(ref), n)
+	if _, err := f.api.do(ctx, "GET", u, nil, &commits); err != nil {
+		return nil, err
+	}
+	var result []*forgeCommit
+	for _, c := range commits {
+		result = append(result, &forgeCommit{SHA: c.SHA, Message: c.Commit.Message})
+	}
+	return result, nil
+}
+
+func (f *giteaForge) CommitFile(ctx context.Context, repo *forgeRepo, branch string, file *forgeFile, content string, commit *newCommit) (string, error) {
+	body := map[string]interface{}{
+		"branch":  branch,
+		"content": base64.StdEncoding.EncodeToString([]byte(content)),
+		"message": commit.Message,
+		"sha":     file.SHA,
+	}
+	if commit.Author != nil {
+		body["author"] = map[string]string{"name": commit.Author.Name, "email": commit.Author.Email}
+	}
+	if commit.Committer != nil {
+		body["committer"] = map[string]string{"name": commit.Committer.Name, "email": commit.Committer.Email}
+	}
+	var resp struct {
+		Commit struct {
+			SHA string `json:"sha"`
+		} `json:"commit"`
+	}
+	u := fmt.Sprintf("%s/contents/%s", giteaRepoPath(repo.Owner, repo.Name), escapePath(file.Path))
+	if _, err := f.api.do(ctx, "PUT", u, body, &resp); err != nil {
+		return "", err
+	}
+	return resp.Commit.SHA, nil
+}
+
+func (f *giteaForge) OpenPR(ctx context.Context, upstream, fork *forgeRepo, pr *newPullRequest) (*forgePR, error) {
+	head := pr.Head
+	if fork.ID != upstream.ID {
+		head = fork.Owner + ":" + pr.Head
+	}
+	body := map[string]string{
+		"title": pr.Title,
+		"body":  pr.Body,
+		"head":  head,
+		"base":  pr.Base,
+	}
+	var created giteaPR
+	if _, err := f.api.do(ctx, "POST", giteaRepoPath(upstream.Owner, upstream.Name)+"/pulls", body, &created); err != nil {
+		return nil, err
+	}
+	return created.forgePR(), nil
+}
+
+func (f *giteaForge) CreateBranch(ctx context.Context, repo *forgeRepo, branch string) error {
+	branches := giteaRepoPath(repo.Owner, repo.Name) + "/branches"
+	body := map[string]string{
+		"new_branch_name": branch,
+		"old_branch_name": repo.DefaultBranch,
+	}
+	_, err := f.api.do(ctx, "POST", branches, body, nil)
+	if errorStatus(err) == http.StatusConflict {
+		// The branch is left over from an earlier run, start it over.
+		if _, err := f.api.do(ctx, "DELETE", branches+"/"+url.PathEscape(branch), nil, nil); err != nil {
+			return err
+		}
+		_, err = f.api.do(ctx, "POST", branches, body, nil)
+	}
+	return err
+}
+
+func (f *giteaForge) RequestReviewers(ctx context.Context, repo *forgeRepo, pr *forgePR, users, teams []string) error {
+	body := map[string][]string{
+		"reviewers":      users,
+		"team_reviewers": teams,
+	}
+	u := fmt.Sprintf("%s/pulls/%d/requested_reviewers", giteaRepoPath(repo.Owner, repo.Name), pr.Number)
+	_, err := f.api.do(ctx, "POST", u, body, nil)
+	return err
+}
+
+func (f *giteaForge) ListPRs(ctx context.Context, repo *forgeRepo, head string) ([]*forgePR, error) {
+	// Gitea cannot filter by head, but the bot opens every PR it looks
+	// for, so only its own have to be paged through.
+	login, err := f.User(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	const limit = 50
+	var result []*forgePR
+	for page := 1; ; page++ {
+		var prs []*giteaPR
+		u := fmt.Sprintf("%s/pulls?state=all&poster=%s&page=%d&limit=%d", giteaRepoPath(repo.Owner, repo.Name), url.QueryEscape(login), page, limit)
+		if _, err := f.api.do(ctx, "GET", u, nil, &prs); err != nil {
+			return nil, err
+		}
+		for _, pr := range prs {
+			if pr.Head.Repo.Owner.Login+":"+pr.Head.Ref == head {
+				result = append(result, pr.forgePR())
+			}
+		}
+		if len(prs) < limit {
+			return result, nil
+		}
+	}
+}
+
+func (f *giteaForge) GetPR(ctx context.Context, repo *forgeRepo, number int) (*forgePR, error) {
+	var pr giteaPR
+	u := fmt.Sprintf("%s/pulls/%d", giteaRepoPath(repo.Owner, repo.Name), number)
+	if _, err := f.api.do(ctx, "GET", u, nil, &pr); err != nil {
+		return nil, err
+	}
+	return pr.forgePR(), nil
+}
+
+func (f *giteaForge) Comments(ctx context.Context, repo *forgeRepo, number int) ([]*forgeComment, error) {
+	var comments []struct {
+		Body    string    `json:"body"`
+		User    giteaUser `json:"user"`
+		Created time.Time `json:"created_at"`
+	}
+	u := fmt.Sprintf("%s/issues/%d/comments", giteaRepoPath(repo.Owner, repo.Name), number)
+	if _, err := f.api.do(ctx, "GET", u, nil, &comments); err != nil {
+		return nil, err
+	}
+	var result []*forgeComment
+	for _, c := range comments {
+		result = append(result, &forgeComment{Author: c.User.Login, Body: c.Body, CreatedAt: c.Created})
+	}
+	return result, nil
+}
+
+func (f *giteaForge) IssueComments(ctx context.Context, repo *forgeRepo, since time.Time) ([]*forgeComment, error) {
+	var result []*forgeComment
+	for page := 1; ; page++ {
+		var comments []struct {
+			ID       int64     `json:"id"`
+			IssueURL string    `json:"issue_url"`
+			Body     string    `json:"body"`
+			User     giteaUser `json:"user"`
+			Created  time.Time `json:"created_at"`
+		}
+		u := fmt.Sprintf("%s/issues/comments?since=%s&page=%d&limit=50", giteaRepoPath(repo.Owner, repo.Name), url.QueryEscape(since.Format(time.RFC3339)), page)
+		if _, err := f.api.do(ctx, "GET", u, nil, &comments); err != nil {
+			return nil, err
+		}
+		for _, c := range comments {
+			issue, _ := strconv.Atoi(c.IssueURL[strings.LastIndex(c.IssueURL, "/")+1:])
+			result = append(result, &forgeComment{ID: c.ID, Issue: issue, Author: c.User.Login, Body: c.Body, CreatedAt: c.Created})
+		}
+		if len(comments) < 50 {
+			return result, nil
+		}
+	}
+}
+
+func (f *giteaForge) CreateComment(ctx context.Context, repo *forgeRepo, number int, body string) error {
+	u := fmt.Sprintf("%s/issues/%d/comments", giteaRepoPath(repo.Owner, repo.Name), number)
+	_, err := f.api.do(ctx, "POST", u, map[string]string{"body": body}, nil)
+	return err
+}
+
+func (f *giteaForge) IsTeamMember(ctx context.Context, team, user string) (bool, error) {
+	i := strings.Index(team, "/")
+	if i < 0 {
+		return false, fmt.Errorf("team %q must be given as org/team", team)
+	}
+	org, name := team[:i], team[i+1:]
+
+	var found struct {
+		Data []struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	u := fmt.Sprintf("orgs/%s/teams/search?q=%s", url.PathEscape(org), url.QueryEscape(name))
+	if _, err := f.api.do(ctx, "GET", u, nil, &found); err != nil {
+		return false, err
+	}
+	for _, t := range found.Data {
+		if !strings.EqualFold(t.Name, name) {
+			continue
+		}
+		_, err := f.api.do(ctx, "GET", fmt.Sprintf("teams/%d/members/%s", t.ID, url.PathEscape(user)), nil, nil)
+		if errorStatus(err) == http.StatusNotFound {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	return false, fmt.Errorf("no team %s in %s", name, org)
+}
+
+func (f *giteaForge) CommitChecks(ctx context.Context, repo *forgeRepo, sha string) ([]commitCheck, error) {
+	// Gitea Actions report through commit statuses too.
+	var statuses []struct {
+		Context string `json:"context"`
+		Status  string `json:"status"`
+	}
+	u := fmt.Sprintf("%s/commits/%s/statuses?limit=50", giteaRepoPath(repo.Owner, repo.Name), url.PathEscape(sha))
+	if _, err := f.api.do(ctx, "GET", u, nil, &statuses); err != nil {
+		return nil, err
+	}
+
+	// Statuses come newest first and may repeat a context.
+	seen := map[string]bool{}
+	var checks []commitCheck
+	for _, s := range statuses {
+		if seen[s.Context] {
+			continue
+		}
+		seen[s.Context] = true
+
+		state := checkPending
+		switch s.Status {
+		case "success", "warning":
+			state = checkSuccess
+		case "failure", "error":
+			state = checkFailure
+		}
+		checks = append(checks, commitCheck{Name: s.Context, State: state})
+	}
+	return checks, nil
+}
+
+func (f *giteaForge) EnableAutoMerge(ctx context.Context, repo *forgeRepo, pr *forgePR) error {
+	return f.merge(ctx, repo, pr, true)
+}
+
+func (f *giteaForge) MergePR(ctx context.Context, repo *forgeRepo, pr *forgePR) error {
+	return f.merge(ctx, repo, pr, false)
+}
+
+func (f *giteaForge) merge(ctx context.Context, repo *forgeRepo, pr *forgePR, whenChecksSucceed bool) error {
+	body := map[string]interface{}{
+		"Do":                        "merge",
+		"head_commit_id":            pr.HeadSHA,
+		"merge_when_checks_succeed": whenChecksSucceed,
+	}
+	u := fmt.Sprintf("%s/pulls/%d/merge", giteaRepoPath(repo.Owner, repo.Name), pr.Number)
+	_, err := f.api.do(ctx, "POST", u, body, nil)
+	return err
+}
+
+func giteaRepoPath(owner, name string) string {
+	return fmt.Sprintf("repos/%s/%s", url.PathEscape(owner), url.PathEscape(name))
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+// githubForge talks to GitHub or GitHub Enterprise.
+type githubForge struct {
+	client *github.Client
+	// signer signs the commits the bot makes, if set.
+	signer commitSigner
+}
+
+func (f *githubForge) Name() string { return "github" }
+
+func (f *githubForge) User(ctx context.Context) (string, error) {
+	// The empty string being passed let's the GitHub API know we want
+	// ourself.
+	user, _, err := f.client.Users.Get(ctx, "")
+	if err != nil {
+		return "", err
+	}
+	return user.GetLogin(), nil
+}
+
+func (f *githubForge) Search(ctx context.Context, query string, page int, found func(*forgeRepo) bool) error {
+	opts := &github.SearchOptions{Sort: "indexed", Order: "asc", ListOptions: github.ListOptions{Page: page}}
+	for {
+		var (
+			results *github.CodeSearchResult
+			resp    *github.Response
+		)
+		_, err := retry(ctx, stageSearch, func() error {
+			var err error
+			results, resp, err = f.client.Search.Code(ctx, query, opts)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("searching page %d failed: %v", opts.Page, err)
+		}
+		searchPages.inc()
+		// logrus.Infof("Total Search Results: %v", results.GetTotal())
+
+		for _, cr := range results.CodeResults {
+			if !found(fromGitHubRepo(cr.GetRepository())) {
+				return nil
+			}
+		}
+
+		if resp.NextPage == 0 {
+			return nil
+		}
+
+		opts.Page = resp.NextPage
+		logrus.Debugf("Going to page %d", resp.NextPage)
+		// to stay within search rate limit
+		time.Sleep(4 * time.Second)
+	}
+}
+
+func (f *githubForge) ListRepos(ctx context.Context, owner string, found func(*forgeRepo) bool) error {
+	var user *github.User
+	_, err := retry(ctx, stageSearch, func() error {
+		var err error
+		user, _, err = f.client.Users.Get(ctx, owner)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	isOrg := user.GetType() == "Organization"
+
+	opts := github.ListOptions{PerPage: 100}
+	for {
+		var (
+			repos []*github.Repository
+			resp  *github.Response
+		)
+		_, err := retry(ctx, stageSearch, func() error {
+			var err error
+			if isOrg {
+				repos, resp, err = f.client.Repositories.ListByOrg(ctx, owner, &github.RepositoryListByOrgOptions{Type: "sources", ListOptions: opts})
+			} else {
+				repos, resp, err = f.client.Repositories.List(ctx, owner, &github.RepositoryListOptions{Type: "owner", ListOptions: opts})
+			}
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("listing repositories of %s failed: %v", owner, err)
+		}
+
+		for _, repo := range repos {
+			if repo.GetFork() {
+				continue
+			}
+			if !found(fromGitHubRepo(repo)) {
+				return nil
+			}
+		}
+
+		if resp.NextPage == 0 {
+			return nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (f *githubForge) GetRepo(ctx context.Context, owner, name string) (*forgeRepo, error) {
+	repo, _, err := f.client.Repositories.Get(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	return fromGitHubRepo(repo), nil
+}
+
+func (f *githubForge) Fork(ctx context.Context, upstream *forgeRepo) (*forgeRepo, error) {
+	repo := upstream.github()
+
+	// reuse a fork we made before, wherever it lives now
+	fork, attempts, err := resolveFork(ctx, f.client, repo)
+	if err != nil {
+		return nil, &stageError{stageFork, attempts, err}
+	}
+
+	if fork == nil {
+		attempts, err := retry(ctx, stageFork, func() error {
+			var err error
+			fork, _, err = f.client.Repositories.CreateFork(ctx, repo.GetOwner().GetLogin(), repo.GetName(), new(github.RepositoryCreateForkOptions))
+			if _, ok := err.(*github.AcceptedError); ok {
+				// The fork is being created in the background, which is
+				// what we asked for.
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return nil, &stageError{stageFork, attempts, err}
+		}
+
+		// GitHub picks a different name for the fork if the bot already
+		// owns a repo with this one, so always go by what it tells us.
+		if fork.GetName() != repo.GetName() {
+			logrus.Infof("Fork of %s was created as %s", repo.GetFullName(), fork.GetFullName())
+		}
+
+		// logrus.Debugf("Sleeping after fork creation of %s", repo.GetName())
+		time.Sleep(2 * time.Second)
+	}
+
+	// verify that the forked repo is fully created, going by ID so a
+	// renamed fork or one that clashed with an existing repo still resolves
+	fork, attempts, err = getForkByID(ctx, f.client, fork.GetID(), repo.GetID())
+	if err != nil {
+		return nil, &stageError{stageForkReady, attempts, err}
+	}
+	if err := state.registerFork(fromGitHubRepo(fork.GetParent()), fromGitHubRepo(fork)); err != nil {
+		logrus.Warnf("saving fork of %s failed: %v", repo.GetFullName(), err)
+	}
+
+	// bring an old fork up to date with upstream
+	if attempts, err := syncFork(ctx, f.client, fork); err != nil {
+		return nil, &stageError{stageSync, attempts, err}
+	}
+	return fromGitHubRepo(fork), nil
+}
+
+func (f *githubForge) ReadFile(ctx context.Context, repo *forgeRepo, path, ref string) (*forgeFile, error) {
+	file, _, _, err := f.client.Repositories.GetContents(ctx, repo.Owner, repo.Name, path, &github.RepositoryContentGetOptions{Ref: ref})
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get file content: %v", err)
+	}
+	return &forgeFile{Path: file.GetPath(), SHA: file.GetSHA(), Content: content}, nil
+}
+
+func (f *githubForge) Commits(ctx context.Context, repo *forgeRepo, ref string, n int) ([]*forgeCommit, error) {
+	commits, _, err := f.client.Repositories.ListCommits(ctx, repo.Owner, repo.Name, &github.CommitsListOptions{SHA: ref, ListOptions: github.ListOptions{PerPage: n}})
+	if err != nil {
+		return nil, err
+	}
+	var result []*forgeCommit
+	for _, c := range commits {
+		result = append(result, &forgeCommit{SHA: c.GetSHA(), Message: c.GetCommit().GetMessage()})
+	}
+	return result, nil
+}
+
+func (f *githubForge) CommitFile(ctx context.Context, repo *forgeRepo, branch string, file *forgeFile, content string, commit *newCommit) (string, error) {
+	if f.signer != nil {
+		return f.commitSigned(ctx, repo, branch, file, content, commit)
+	}
+
+	// create commit
+	opts := &github.RepositoryContentFileOptions{
+		Content:   []byte(content),
+		Message:   &commit.Message,
+		SHA:       &file.SHA,
+		Branch:    &branch,
+		Author:    commit.Author.github(),
+		Committer: commit.Committer.github(),
+	}
+	resp, _, err := f.client.Repositories.UpdateFile(ctx, repo.Owner, repo.Name, file.Path, opts)
+	if err != nil {
+		return "", err
+	}
+	return resp.GetSHA(), nil
+}
+
+// commitSigned builds and signs the commit itself and pushes it through the
+// Git Data API, since the contents API can't take a signature.
+func (f *githubForge) commitSigned(ctx context.Context, repo *forgeRepo, branch string, file *forgeFile, content string, commit *newCommit) (string, error) {
+	if commit.Author == nil || commit.Committer == nil {
+		return "", fmt.Errorf("signed commits need an author and committer")
+	}
+
+	ref, _, err := f.client.Git.GetRef(ctx, repo.Owner, repo.Name, "heads/"+branch)
+	if err != nil {
+		return "", err
+	}
+	parent, _, err := f.client.Git.GetCommit(ctx, repo.Owner, repo.Name, ref.GetObject().GetSHA())
+	if err != nil {
+		return "", err
+	}
+
+	blob, _, err := f.client.Git.CreateBlob(ctx, repo.Owner, repo.Name, &github.Blob{
+		Content:  github.String(base64.StdEncoding.EncodeToString([]byte(content))),
+		Encoding: github.String("base64"),
+	})
+	if err != nil {
+		return "", err
+	}
+	tree, _, err := f.client.Git.CreateTree(ctx, repo.Owner, repo.Name, parent.GetTree().GetSHA(), []github.TreeEntry{{
+		Path: github.String(file.Path),
+		Mode: github.String("100644"),
+		Type: github.String("blob"),
+		SHA:  blob.SHA,
+	}})
+	if err != nil {
+		return "", err
+	}
+
+	// GitHub checks the signature against the commit object it builds
+	// from what we send, so the payload has to match it byte for byte.
+	when := time.Now().UTC().Truncate(time.Second)
+	parents := []string{parent.GetSHA()}
+	signature, err := f.signer.Sign(commitPayload(tree.GetSHA(), parents, commit.Author, commit.Committer, when, commit.Message))
+	if err != nil {
+		return "", fmt.Errorf("signing commit failed: %v", err)
+	}
+
+	// go-github has no signature field on commits yet.
+	identity := func(id *commitIdentity) map[string]string {
+		return map[string]string{"name": id.Name, "email": id.Email, "date": when.Format(time.RFC3339)}
+	}
+	body := map[string]interface{}{
+		"message":   commit.Message,
+		"tree":      tree.GetSHA(),
+		"parents":   parents,
+		"author":    identity(commit.Author),
+		"committer": identity(commit.Committer),
+		"signature": signature,
+	}
+	req, err := f.client.NewRequest("POST", fmt.Sprintf("repos/%s/%s/git/commits", repo.Owner, repo.Name), body)
+	if err != nil {
+		return "", err
+	}
+	var created github.Commit
+	if _, err := f.client.Do(ctx, req, &created); err != nil {
+		return "", err
+	}
+
+	ref.Object.SHA = created.SHA
+	if _, _, err := f.client.Git.UpdateRef(ctx, repo.Owner, repo.Name, ref, false); err != nil {
+		return "", err
+	}
+	return created.GetSHA(), nil
+}
+
+func (f *githubForge) OpenPR(ctx context.Context, upstream, fork *forgeRepo, pr *newPullRequest) (*forgePR, error) {
+	head := fork.Owner + ":" + pr.Head
+
+	opts := &github.NewPullRequest{}
+	opts.Title = &pr.Title
+	opts.Head = &head
+	opts.Base = &pr.Base
+	opts.Body = &pr.Body
+	if fork.ID != upstream.ID {
+		canEdit := true
+		opts.MaintainerCanModify = &canEdit
+	}
+
+	created, _, err := f.client.PullRequests.Create(ctx, upstream.Owner, upstream.Name, opts)
+	if err != nil {
+		return nil, err
+	}
+	return fromGitHubPR(created), nil
+}
+
+func (f *githubForge) CreateBranch(ctx context.Context, repo *forgeRepo, branch string) error {
+	base := repo.DefaultBranch
+	if base == "" {
+		base = "master"
+	}
+	baseRef, _, err := f.client.Git.GetRef(ctx, repo.Owner, repo.Name, "heads/"+base)
+	if err != nil {
+		return err
+	}
+
+	ref := &github.Reference{
+		Ref:    github.String("refs/heads/" + branch),
+		Object: &github.GitObject{SHA: baseRef.GetObject().SHA},
+	}
+	_, _, err = f.client.Git.CreateRef(ctx, repo.Owner, repo.Name, ref)
+	if errorStatus(err) == http.StatusUnprocessableEntity {
+		// The branch is left over from an earlier run, start it over.
+		_, _, err = f.client.Git.UpdateRef(ctx, repo.Owner, repo.Name, ref, true)
+	}
+	return err
+}
+
+func (f *githubForge) RequestReviewers(ctx context.Context, repo *forgeRepo, pr *forgePR, users, teams []string) error {
+	_, _, err := f.client.PullRequests.RequestReviewers(ctx, repo.Owner, repo.Name, pr.Number, github.ReviewersRequest{Reviewers: users, TeamReviewers: teams})
+	return err
+}
+
+func (f *githubForge) ListPRs(ctx context.Context, repo *forgeRepo, head string) ([]*forgePR, error) {
+	prs, _, err := f.client.PullRequests.List(ctx, repo.Owner, repo.Name, &github.PullRequestListOptions{State: "all", Head: head})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*forgePR
+	for _, pr := range prs {
+		result = append(result, fromGitHubPR(pr))
+	}
+	return result, nil
+}
+
+func (f *githubForge) GetPR(ctx context.Context, repo *forgeRepo, number int) (*forgePR, error) {
+	pr, _, err := f.client.PullRequests.Get(ctx, repo.Owner, repo.Name, number)
+	if err != nil {
+		return nil, err
+	}
+	return fromGitHubPR(pr), nil
+}
+
+func (f *githubForge) Comments(ctx context.Context, repo *forgeRepo, number int) ([]*forgeComment, error) {
+	opt := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	var result []*forgeComment
+	for {
+		comments, resp, err := f.client.Issues.ListComments(ctx, repo.Owner, repo.Name, number, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range comments {
+			result = append(result, &forgeComment{Author: c.GetUser().GetLogin(), Body: c.GetBody(), CreatedAt: c.GetCreatedAt()})
+		}
+		if resp.NextPage == 0 {
+			return result, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (f *githubForge) IssueComments(ctx context.Context, repo *forgeRepo, since time.Time) ([]*forgeComment, error) {
+	opt := &github.IssueListCommentsOptions{
+		Sort:        "created",
+		Direction:   "asc",
+		Since:       since,
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	var result []*forgeComment
+	for {
+		// Issue number 0 lists the comments on every issue.
+		comments, resp, err := f.client.Issues.ListComments(ctx, repo.Owner, repo.Name, 0, opt)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range comments {
+			issueURL := c.GetIssueURL()
+			issue, _ := strconv.Atoi(issueURL[strings.LastIndex(issueURL, "/")+1:])
+			result = append(result, &forgeComment{
+				ID:        c.GetID(),
+				Issue:     issue,
+				Author:    c.GetUser().GetLogin(),
+				Body:      c.GetBody(),
+				CreatedAt: c.GetCreatedAt(),
+			})
+		}
+		if resp.NextPage == 0 {
+			return result, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (f *githubForge) CreateComment(ctx context.Context, repo *forgeRepo, number int, body string) error {
+	_, _, err := f.client.Issues.CreateComment(ctx, repo.Owner, repo.Name, number, &github.IssueComment{Body: github.String(body)})
+	return err
+}
+
+func (f *githubForge) IsTeamMember(ctx context.Context, team, user string) (bool, error) {
+	i := strings.Index(team, "/")
+	if i < 0 {
+		return false, fmt.Errorf("team %q must be given as org/team", team)
+	}
+	org, slug := team[:i], team[i+1:]
+
+	// This version of the API has no lookup by slug.
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		teams, resp, err := f.client.Teams.ListTeams(ctx, org, opt)
+		if err != nil {
+			return false, err
+		}
+		for _, t := range teams {
+			if t.GetSlug() != slug {
+				continue
+			}
+			membership, _, err := f.client.Teams.GetTeamMembership(ctx, t.GetID(), user)
+			if errorStatus(err) == http.StatusNotFound {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			return membership.GetState() == "active", nil
+		}
+		if resp.NextPage == 0 {
+			return false, fmt.Errorf("no team %s in %s", slug, org)
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+func (f *githubForge) CommitChecks(ctx context.Context, repo *forgeRepo, sha string) ([]commitCheck, error) {
+	status, _, err := f.client.Repositories.GetCombinedStatus(ctx, repo.Owner, repo.Name, sha, &github.ListOptions{PerPage: 100})
+	if err != nil {
+		return nil, err
+	}
+	var checks []commitCheck
+	for _, s := range status.Statuses {
+		state := checkPending
+		switch s.GetState() {
+		case "success":
+			state = checkSuccess
+		case "failure", "error":
+			state = checkFailure
+		}
+		checks = append(checks, commitCheck{Name: s.GetContext(), State: state})
+	}
+
+	opts := &github.ListCheckRunsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		runs, resp, err := f.client.Checks.ListCheckRunsForRef(ctx, repo.Owner, repo.Name, sha, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, run := range runs.CheckRuns {
+			state := checkPending
+			if run.GetStatus() == "completed" {
+				state = checkSuccess
+				switch run.GetConclusion() {
+				case "failure", "cancelled", "timed_out", "action_required":
+					state = checkFailure
+				}
+			}
+			checks = append(checks, commitCheck{Name: run.GetName(), State: state})
+		}
+		if resp.NextPage == 0 {
+			return checks, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+func (f *githubForge) EnableAutoMerge(ctx context.Context, repo *forgeRepo, pr *forgePR) error {
+	// Auto-merge is only exposed through GraphQL, which wants the node ID.
+	current, _, err := f.client.PullRequests.Get(ctx, repo.Owner, repo.Name, pr.Number)
+	if err != nil {
+		return err
+	}
+
+	body := map[string]interface{}{
+		"query": `mutation($id: ID!) { enablePullRequestAutoMerge(input: {pullRequestId: $id}) { clientMutationId } }`,
+		"variables": map[string]string{
+			"id": current.GetNodeID(),
+		},
+	}
+	// GraphQL lives next to the REST API, at /graphql on github.com and
+	// /api/graphql on GitHub Enterprise.
+	req, err := f.client.NewRequest("POST", "../graphql", body)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if _, err := f.client.Do(ctx, req, &resp); err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("enabling auto-merge on %s failed: %s", pr.URL, resp.Errors[0].Message)
+	}
+	return nil
+}
+
+func (f *githubForge) MergePR(ctx context.Context, repo *forgeRepo, pr *forgePR) error {
+	_, _, err := f.client.PullRequests.Merge(ctx, repo.Owner, repo.Name, pr.Number, "", &github.PullRequestOptions{SHA: pr.HeadSHA})
+	return err
+}
+
+func fromGitHubRepo(r *github.Repository) *forgeRepo {
+	if r == nil {
+		return nil
+	}
+	return &forgeRepo{
+		ID:            r.GetID(),
+		Owner:         r.GetOwner().GetLogin(),
+		Name:          r.GetName(),
+		DefaultBranch: r.GetDefaultBranch(),
+		HTMLURL:       r.GetHTMLURL(),
+		Archived:      r.GetArchived(),
+		Fork:          r.GetFork(),
+		Stars:         r.GetStargazersCount(),
+		PushedAt:      r.GetPushedAt().Time,
+		CanPush:       r.Permissions != nil && (*r.Permissions)["push"],
+		Parent:        fromGitHubRepo(r.Parent),
+	}
+}
+
+// github converts r back into the fields of a github.Repository the
+// GitHub specific helpers rely on.
+func (r *forgeRepo) github() *github.Repository {
+	if r == nil {
+		return nil
+	}
+	fullName := r.FullName()
+	return &github.Repository{
+		ID:            &r.ID,
+		Owner:         &github.User{Login: &r.Owner},
+		Name:          &r.Name,
+		FullName:      &fullName,
+		DefaultBranch: &r.DefaultBranch,
+		HTMLURL:       &r.HTMLURL,
+		Archived:      &r.Archived,
+		Fork:          &r.Fork,
+		Parent:        r.Parent.github(),
+	}
+}
+
+func (id *commitIdentity) github() *github.CommitAuthor {
+	if id == nil {
+		return nil
+	}
+	return &github.CommitAuthor{Name: &id.Name, Email: &id.Email}
+}
+
+func fromGitHubPR(pr *github.PullRequest) *forgePR {
+	// GitHub leaves mergeable_state "unknown" until it has computed it,
+	// and calls it "unstable" when only optional checks are failing.
+	mergeable := false
+	switch pr.GetMergeableState() {
+	case "clean", "has_hooks", "unstable":
+		mergeable = true
+	}
+	return &forgePR{
+		Number:    pr.GetNumber(),
+		URL:       pr.GetHTMLURL(),
+		State:     pr.GetState(),
+		HeadSHA:   pr.GetHead().GetSHA(),
+		BaseSHA:   pr.GetBase().GetSHA(),
+		Merged:    pr.GetMerged(),
+		Mergeable: mergeable,
+		CreatedAt: pr.GetCreatedAt(),
+		ClosedAt:  pr.GetClosedAt(),
+	}
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// gitlabForge talks to the GitLab v4 API and maps pull requests onto merge
+// requests.
+type gitlabForge struct {
+	api *restClient
+
+	mu sync.Mutex
+	// login is the bot's username, looked up once.
+	login string
+}
+
+func newGitLabForge(baseURL, token string) (*gitlabForge, error) {
+	api, err := newRESTClient(baseURL, "PRIVATE-TOKEN", token)
+	if err != nil {
+		return nil, err
+	}
+	return &gitlabForge{api: api}, nil
+}
+
+type gitlabProject struct {
+	ID            int64     `json:"id"`
+	Path          string    `json:"path"`
+	DefaultBranch string    `json:"default_branch"`
+	WebURL        string    `json:"web_url"`
+	Archived      bool      `json:"archived"`
+	StarCount     int       `json:"star_count"`
+	LastActivity  time.Time `json:"last_activity_at"`
+	ImportStatus  string    `json:"import_status"`
+	Namespace     struct {
+		FullPath string `json:"full_path"`
+	} `json:"namespace"`
+	ForkedFrom  *gitlabProject `json:"forked_from_project"`
+	Permissions struct {
+		ProjectAccess *gitlabAccess `json:"project_access"`
+		GroupAccess   *gitlabAccess `json:"group_access"`
+	} `json:"permissions"`
+}
+
+type gitlabAccess struct {
+	AccessLevel int `json:"access_level"`
+}
+
+// gitlabDeveloperAccess is the lowest access level that may push branches.
+const gitlabDeveloperAccess = 30
+
+func (p *gitlabProject) canPush() bool {
+	for _, a := range []*gitlabAccess{p.Permissions.ProjectAccess, p.Permissions.GroupAccess} {
+		if a != nil && a.AccessLevel >= gitlabDeveloperAccess {
+			return true
+		}
+	}
+	return false
+}
+
+type gitlabMR struct {
+	IID          int    `json:"iid"`
+	WebURL       string `json:"web_url"`
+	State        string `json:"state"`
+	SHA          string `json:"sha"`
+	SourceBranch string `json:"source_branch"`
+	// SourceProjectID is the project the source branch lives in, the
+	// fork for MRs from forks.
+	SourceProjectID int64 `json:"source_project_id"`
+	DiffRefs        struct {
+		BaseSHA string `json:"base_sha"`
+	} `json:"diff_refs"`
+	// DetailedMergeStatus replaces MergeStatus on GitLab 15.6 and later.
+	MergeStatus         string `json:"merge_status"`
+	DetailedMergeStatus string `json:"detailed_merge_status"`
+	Author              struct {
+		Username string `json:"username"`
+	} `json:"author"`
+	CreatedAt time.Time  `json:"created_at"`
+	ClosedAt  *time.Time `json:"closed_at"`
+	MergedAt  *time.Time `json:"merged_at"`
+}
+
+func (mr *gitlabMR) forgePR() *forgePR {
+	state := mr.State
+	if state == "opened" {
+		state = "open"
+	}
+	mergeable := mr.DetailedMergeStatus == "mergeable"
+	if mr.DetailedMergeStatus == "" {
+		mergeable = mr.MergeStatus == "can_be_merged"
+	}
+	pr := &forgePR{
+		Number:    mr.IID,
+		URL:       mr.WebURL,
+		State:     state,
+		HeadSHA:   mr.SHA,
+		BaseSHA:   mr.DiffRefs.BaseSHA,
+		Merged:    mr.State == "merged",
+		Mergeable: mergeable,
+		CreatedAt: mr.CreatedAt,
+	}
+	switch {
+	case mr.MergedAt != nil:
+		pr.ClosedAt = *mr.MergedAt
+	case mr.ClosedAt != nil:
+		pr.ClosedAt = *mr.ClosedAt
+	}
+	return pr
+}
+
+func (p *gitlabProject) forgeRepo() *forgeRepo {
+	if p == nil {
+		return nil
+	}
+	return &forgeRepo{
+		ID:            p.ID,
+		Owner:         p.Namespace.FullPath,
+		Name:          p.Path,
+		DefaultBranch: p.DefaultBranch,
+		HTMLURL:       p.WebURL,
+		Archived:      p.Archived,
+		Fork:          p.ForkedFrom != nil,
+		Stars:         p.StarCount,
+		PushedAt:      p.LastActivity,
+		CanPush:       p.canPush(),
+		Parent:        p.ForkedFrom.forgeRepo(),
+	}
+}
+
+func (f *gitlabForge) Name() string { return "gitlab" }
+
+func (f *gitlabForge) User(ctx context.Context) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.login != "" {
+		return f.login, nil
+	}
+
+	var u struct {
+		Username string `json:"username"`
+	}
+	if _, err := f.api.do(ctx, "GET", "user", nil, &u); err != nil {
+		return "", err
+	}
+	f.login = u.Username
+	return u.Username, nil
+}
+
+func (f *gitlabForge) Search(ctx context.Context, query string, page int, found func(*forgeRepo) bool) error {
+	if page < 1 {
+		page = 1
+	}
+	seen := map[int64]bool{}
+	for {
+		var (
+			blobs []struct {
+				ProjectID int64 `json:"project_id"`
+			}
+			resp *http.Response
+		)
+		_, err := retry(ctx, stageSearch, func() error {
+			var err error
+			resp, err = f.api.do(ctx, "GET", fmt.Sprintf("search?scope=blobs&search=%s&page=%d&per_page=100", url.QueryEscape(query), page), nil, &blobs)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("searching page %d failed: %v", page, err)
+		}
+		searchPages.inc()
+
+		for _, blob := range blobs {
+			if seen[blob.ProjectID] {
+				continue
+			}
+			seen[blob.ProjectID] = true
+
+			repo, err := f.getProject(ctx, strconv.FormatInt(blob.ProjectID, 10))
+			if err != nil {
+				// one project we cannot read should not end the search
+				logrus.Warnf("getting project %d failed, skipping it: %v", blob.ProjectID, err)
+				continue
+			}
+			if !found(repo) {
+				return nil
+			}
+		}
+
+		next, _ := strconv.Atoi(resp.Header.Get("X-Next-Page"))
+		if next == 0 {
+			return nil
+		}
+		page = next
+	}
+}
+
+func (f *gitlabForge) ListRepos(ctx context.Context, owner string, found func(*forgeRepo) bool) error {
+	// Groups and users have separate endpoints; try the group first.
+	base := fmt.Sprintf("groups/%s/projects", url.PathEscape(owner))
+	if _, err := f.api.do(ctx, "GET", fmt.Sprintf("groups/%s", url.PathEscape(owner)), nil, nil); err != nil {
+		if e, ok := err.(*httpError); !ok || e.StatusCode != http.StatusNotFound {
+			return err
+		}
+		base = fmt.Sprintf("users/%s/projects", url.PathEscape(owner))
+	}
+
+	for page := 1; page != 0; {
+		var (
+			projects []*gitlabProject
+			resp     *http.Response
+		)
+		_, err := retry(ctx, stageSearch, func() error {
+			var err error
+			resp, err = f.api.do(ctx, "GET", fmt.Sprintf("%s?page=%d&per_page=100", base, page), nil, &projects)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("listing projects of %s failed: %v", owner, err)
+		}
+
+		for _, p := range projects {
+			if p.ForkedFrom != nil {
+				continue
+			}
+			if !found(p.forgeRepo()) {
+				return nil
+			}
+		}
+		page, _ = strconv.Atoi(resp.Header.Get("X-Next-Page"))
+	}
+	return nil
+}
+
+func (f *gitlabForge) GetRepo(ctx context.Context, owner, name string) (*forgeRepo, error) {
+	return f.getProject(ctx, url.PathEscape(owner+"/"+name))
+}
+
+// getProject fetches a project by its ID or URL encoded path.
+func (f *gitlabForge) getProject(ctx context.Context, id string) (*forgeRepo, error) {
+	var p gitlabProject
+	if _, err := f.api.do(ctx, "GET", "projects/"+id, nil, &p); err != nil {
+		return nil, err
+	}
+	return p.forgeRepo(), nil
+}
+
+func (f *gitlabForge) Fork(ctx context.Context, upstream *forgeRepo) (*forgeRepo, error) {
+	// reuse a fork we made before, wherever it lives now
+	fork, attempts, err := resolveForgeFork(ctx, upstream, func(id int64) (*forgeRepo, error) {
+		return f.getProject(ctx, strconv.FormatInt(id, 10))
+	})
+	if err != nil {
+		return nil, &stageError{stageFork, attempts, err}
+	}
+	if fork == nil {
+		if fork, err = f.newFork(ctx, upstream); err != nil {
+			return nil, err
+		}
+	}
+	if err := state.registerFork(upstream, fork); err != nil {
+		logrus.Warnf("saving fork of %s failed: %v", upstream.FullName(), err)
+	}
+
+	warnStaleFork(ctx, f, upstream, fork)
+	return fork, nil
+}
+
+// newFork forks upstream into the bot's namespace, or finds the fork there,
+// and waits for GitLab to finish importing it.
+func (f *gitlabForge) newFork(ctx context.Context, upstream *forgeRepo) (*forgeRepo, error) {
+	login, err := f.User(ctx)
+	if err != nil {
+		return nil, &stageError{stageFork, 1, err}
+	}
+
+	// reuse an existing fork in the bot's namespace
+	var forks []*gitlabProject
+	if _, err := f.api.do(ctx, "GET", fmt.Sprintf("projects/%d/forks?owned=true", upstream.ID), nil, &forks); err != nil {
+		return nil, &stageError{stageFork, 1, err}
+	}
+	var fork *gitlabProject
+	for _, p := range forks {
+		if p.Namespace.FullPath == login {
+			fork = p
+			break
+		}
+	}
+
+	if fork == nil {
+		fork = new(gitlabProject)
+		attempts, err := retry(ctx, stageFork, func() error {
+			_, err := f.api.do(ctx, "POST", fmt.Sprintf("projects/%d/fork", upstream.ID), struct{}{}, fork)
+			return err
+		})
+		if err != nil {
+			return nil, &stageError{stageFork, attempts, err}
+		}
+	}
+
+	// GitLab imports the repository in the background.
+	attempts, err := retry(ctx, stageForkReady, func() error {
+		if _, err := f.api.do(ctx, "GET", fmt.Sprintf("projects/%d", fork.ID), nil, fork); err != nil {
+			return err
+		}
+		if fork.ImportStatus != "" && fork.ImportStatus != "none" && fork.ImportStatus != "finished" {
+			return retryableError{fmt.Errorf("fork %s is still being imported: %s", fork.Path, fork.ImportStatus)}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &stageError{stageForkReady, attempts, err}
+	}
+
+	repo := fork.forgeRepo()
+	if repo.Parent == nil {
+		repo.Parent = upstream
+	}
+	return repo, nil
+}
+
+func (f *gitlabForge) ReadFile(ctx context.Context, repo *forgeRepo, path, ref string) (*forgeFile, error) {
+	if ref == "" {
+		ref = repo.DefaultBranch
+	}
+	if ref == "" {
+		ref = "HEAD"
+	}
+
+	var file struct {
+		FilePath string `json:"file_path"`
+		BlobID   string `json:"blob_id"`
+		Content  string `json:"content"`
+	}
+	u := fmt.Sprintf("projects/%d/repository/files/%s?ref=%s", repo.ID, url.PathEscape(path), url.QueryEscape(ref))
+	if _, err := f.api.do(ctx, "GET", u, nil, &file); err != nil {
+		return nil, err
+	}
+
+	b, err := base64.StdEncoding.DecodeString(file.Content)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get file content: %v", err)
+	}
+	return &forgeFile{Path: file.FilePath, SHA: file.BlobID, Content: string(b)}, nil
+}
+
+func (f *gitlabForge) Commits(ctx context.Context, repo *forgeRepo, ref string, n int) ([]*forgeCommit, error) {
+	var commits []struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	u := fmt.Sprintf("projects/%d/repository/commits?ref_name=%s&per_page=%d", repo.ID, url.QueryEscape(ref), n)
+	if _, err := f.api.do(ctx, "GET", u, nil, &commits); err != nil {
+		return nil, err
+	}
+	var result []*forgeCommit
+	for _, c := range commits {
+		result = append(result, &forgeCommit{SHA: c.ID, Message: c.Message})
+	}
+	return result, nil
+}
+
+func (f *gitlabForge) CommitFile(ctx context.Context, repo *forgeRepo, branch string, file *forgeFile, content string, commit *newCommit) (string, error) {
+	body := map[string]interface{}{
+		"branch":         branch,
+		"commit_message": commit.Message,
+		"actions": []map[string]string{{
+			"action":    "update",
+			"file_path": file.Path,
+			"content":   base64.StdEncoding.EncodeToString([]byte(content)),
+			"encoding":  "base64",
+		}},
+	}
+	// GitLab always commits as the authenticated user, only the author
+	// can be set.
+	if commit.Author != nil {
+		body["author_name"] = commit.Author.Name
+		body["author_email"] = commit.Author.Email
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if _, err := f.api.do(ctx, "POST", fmt.Sprintf("projects/%d/repository/commits", repo.ID), body, &created); err != nil {
+		return "", err
+	}
+	return created.ID, nil
+}
+
+func (f *gitlabForge) OpenPR(ctx context.Context, upstream, fork *forgeRepo, pr *newPullRequest) (*forgePR, error) {
+	body := map[string]interface{}{
+		"title":                pr.Title,
+		"description":          pr.Body,
+		"source_branch":        pr.Head,
+		"target_branch":        pr.Base,
+		"target_project_id":    upstream.ID,
+		"allow_collaboration":  true,
+		"remove_source_branch": false,
+	}
+	var mr gitlabMR
+	if _, err := f.api.do(ctx, "POST", fmt.Sprintf("projects/%d/merge_requests", fork.ID), body, &mr); err != nil {
+		return nil, err
+	}
+	return mr.forgePR(), nil
+}
+
+func (f *gitlabForge) CreateBranch(ctx context.Context, repo *forgeRepo, branch string) error {
+	branches := fmt.Sprintf("projects/%d/repository/branches", repo.ID)
+	create := fmt.Sprintf("%s?branch=%s&ref=%s", branches, url.QueryEscape(branch), url.QueryEscape(repo.DefaultBranch))
+	_, err := f.api.do(ctx, "POST", create, nil, nil)
+	if errorStatus(err) == http.StatusBadRequest {
+		// The branch is left over from an earlier run, start it over.
+		if _, err := f.api.do(ctx, "DELETE", branches+"/"+url.PathEscape(branch), nil, nil); err != nil {
+			return err
+		}
+		_, err = f.api.do(ctx, "POST", create, nil, nil)
+	}
+	return err
+}
+
+func (f *gitlabForge) RequestReviewers(ctx context.Context, repo *forgeRepo, pr *forgePR, users, teams []string) error {
+	// GitLab assigns reviewers by user ID and has no team reviewers.
+	var ids []int64
+	for _, name := range users {
+		var found []struct {
+			ID int64 `json:"id"`
+		}
+		if _, err := f.api.do(ctx, "GET", "users?username="+url.QueryEscape(name), nil, &found); err != nil {
+			return err
+		}
+		if len(found) > 0 {
+			ids = append(ids, found[0].ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	body := map[string][]int64{"reviewer_ids": ids}
+	_, err := f.api.do(ctx, "PUT", fmt.Sprintf("projects/%d/merge_requests/%d", repo.ID, pr.Number), body, nil)
+	return err
+}
+
+func (f *gitlabForge) ListPRs(ctx context.Context, repo *forgeRepo, head string) ([]*forgePR, error) {
+	i := strings.LastIndex(head, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("head %q is not in the form owner:branch", head)
+	}
+	owner, branch := head[:i], head[i+1:]
+
+	// The owner of the head is the bot for forks, but upstream itself for
+	// direct branches, so look for MRs the bot opened from the branch and
+	// tell the two apart by the project they come from.
+	login, err := f.User(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var mrs []*gitlabMR
+	u := fmt.Sprintf("projects/%d/merge_requests?state=all&per_page=100&author_username=%s&source_branch=%s", repo.ID, url.QueryEscape(login), url.QueryEscape(branch))
+	if _, err := f.api.do(ctx, "GET", u, nil, &mrs); err != nil {
+		return nil, err
+	}
+
+	direct := owner == repo.Owner
+	var result []*forgePR
+	for _, mr := range mrs {
+		if (mr.SourceProjectID == repo.ID) == direct {
+			result = append(result, mr.forgePR())
+		}
+	}
+	return result, nil
+}
+
+func (f *gitlabForge) GetPR(ctx context.Context, repo *forgeRepo, number int) (*forgePR, error) {
+	var mr gitlabMR
+	if _, err := f.api.do(ctx, "GET", fmt.Sprintf("projects/%d/merge_requests/%d", repo.ID, number), nil, &mr); err != nil {
+		return nil, err
+	}
+	return mr.forgePR(), nil
+}
+
+func (f *gitlabForge) Comments(ctx context.Context, repo *forgeRepo, number int) ([]*forgeComment, error) {
+	var notes []struct {
+		Body   string `json:"body"`
+		System bool   `json:"system"`
+		Author struct {
+			Username string `json:"username"`
+		} `json:"author"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	u := fmt.Sprintf("projects/%d/merge_requests/%d/notes?sort=asc&per_page=100", repo.ID, number)
+	if _, err := f.api.do(ctx, "GET", u, nil, &notes); err != nil {
+		return nil, err
+	}
+	var result []*forgeComment
+	for _, n := range notes {
+		// System notes record events like pushes, not what people said.
+		if n.System {
+			continue
+		}
+		result = append(result, &forgeComment{Author: n.Author.Username, Body: n.Body, CreatedAt: n.CreatedAt})
+	}
+	return result, nil
+}
+
+func (f *gitlabForge) IssueComments(ctx context.Context, repo *forgeRepo, since time.Time) ([]*forgeComment, error) {
+	// There is no list of every note in a project, so look at the notes
+	// of the issues updated since.
+	var issues []int
+	for page := 1; page != 0; {
+		var list []struct {
+			IID int `json:"iid"`
+		}
+		u := fmt.Sprintf("projects/%d/issues?updated_after=%s&page=%d&per_page=100", repo.ID, url.QueryEscape(since.Format(time.RFC3339)), page)
+		resp, err := f.api.do(ctx, "GET", u, nil, &list)
+		if err != nil {
+			return nil, err
+		}
+		for _, issue := range list {
+			issues = append(issues, issue.IID)
+		}
+		page, _ = strconv.Atoi(resp.Header.Get("X-Next-Page"))
+	}
+
+	var result []*forgeComment
+	for _, issue := range issues {
+		for page := 1; page != 0; {
+			var notes []struct {
+				ID     int64  `json:"id"`
+				Body   string `json:"body"`
+				System bool   `json:"system"`
+				Author struct {
+					Username string `json:"username"`
+				} `json:"author"`
+				CreatedAt time.Time `json:"created_at"`
+			}
+			u := fmt.Sprintf("projects/%d/issues/%d/notes?sort=asc&page=%d&per_page=100", repo.ID, issue, page)
+			resp, err := f.api.do(ctx, "GET", u, nil, &notes)
+			if err != nil {
+				return nil, err
+			}
+			for _, n := range notes {
+				if n.System || n.CreatedAt.Before(since) {
+					continue
+				}
+				result = append(result, &forgeComment{ID: n.ID, Issue: issue, Author: n.Author.Username, Body: n.Body, CreatedAt: n.CreatedAt})
+			}
+			page, _ = strconv.Atoi(resp.Header.Get("X-Next-Page"))
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+	return result, nil
+}
+
+func (f *gitlabForge) CreateComment(ctx context.Context, repo *forgeRepo, number int, body string) error {
+	u := fmt.Sprintf("projects/%d/issues/%d/notes", repo.ID, number)
+	_, err := f.api.do(ctx, "POST", u, map[string]string{"body": body}, nil)
+	return err
+}
+
+func (f *gitlabForge) IsTeamMember(ctx context.Context, team, user string) (bool, error) {
+	var members []struct {
+		Username string `json:"username"`
+		State    string `json:"state"`
+	}
+	u := fmt.Sprintf("groups/%s/members/all?query=%s", url.PathEscape(team), url.QueryEscape(user))
+	if _, err := f.api.do(ctx, "GET", u, nil, &members); err != nil {
+		return false, err
+	}
+	for _, m := range members {
+		if strings.EqualFold(m.Username, user) {
+			return m.State == "active", nil
+		}
+	}
+	return false, nil
+}
+
+func (f *gitlabForge) CommitChecks(ctx context.Context, repo *forgeRepo, sha string) ([]commitCheck, error) {
+	var statuses []struct {
+		Name         string `json:"name"`
+		Status       string `json:"status"`
+		AllowFailure bool   `json:"allow_failure"`
+	}
+	u := fmt.Sprintf("projects/%d/repository/commits/%s/statuses?per_page=100", repo.ID, url.PathEscape(sha))
+	if _, err := f.api.do(ctx, "GET", u, nil, &statuses); err != nil {
+		return nil, err
+	}
+
+	var checks []commitCheck
+	for _, s := range statuses {
+		state := checkPending
+		switch s.Status {
+		case "success", "skipped", "manual":
+			state = checkSuccess
+		case "failed", "canceled":
+			state = checkFailure
+			if s.AllowFailure {
+				state = checkSuccess
+			}
+		}
+		checks = append(checks, commitCheck{Name: s.Name, State: state})
+	}
+	return checks, nil
+}
+
+func (f *gitlabForge) EnableAutoMerge(ctx context.Context, repo *forgeRepo, pr *forgePR) error {
+	return f.merge(ctx, repo, pr, true)
+}
+
+func (f *gitlabForge) MergePR(ctx context.Context, repo *forgeRepo, pr *forgePR) error {
+	return f.merge(ctx, repo, pr, false)
+}
+
+func (f *gitlabForge) merge(ctx context.Context, repo *forgeRepo, pr *forgePR, whenPipelineSucceeds bool) error {
+	body := map[string]interface{}{
+		"sha":                          pr.HeadSHA,
+		"merge_when_pipeline_succeeds": whenPipelineSucceeds,
+	}
+	_, err := f.api.do(ctx, "PUT", fmt.Sprintf("projects/%d/merge_requests/%d/merge", repo.ID, pr.Number), body, nil)
+	return err
+}
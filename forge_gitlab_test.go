@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGitLabIssueCommentsPaginates(t *testing.T) {
+	since := time.Date(2018, 10, 1, 0, 0, 0, 0, time.UTC)
+	note := func(id int, minutes int, system bool) string {
+		return fmt.Sprintf(`{"id": %d, "body": "/status", "system": %t, "author": {"username": "alice"}, "created_at": %q}`,
+			id, system, since.Add(time.Duration(minutes)*time.Minute).Format(time.RFC3339))
+	}
+	pages := map[string]struct {
+		next string
+		body string
+	}{
+		"/projects/7/issues?page=1":         {"2", `[{"iid": 1}]`},
+		"/projects/7/issues?page=2":         {"", `[{"iid": 2}]`},
+		"/projects/7/issues/1/notes?page=1": {"", "[" + note(10, -5, false) + "," + note(11, 3, false) + "]"},
+		"/projects/7/issues/2/notes?page=1": {"2", "[" + note(20, 1, true) + "," + note(21, 2, false) + "]"},
+		"/projects/7/issues/2/notes?page=2": {"", "[" + note(22, 4, false) + "]"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path+"?page="+r.URL.Query().Get("page")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if page.next != "" {
+			w.Header().Set("X-Next-Page", page.next)
+		}
+		fmt.Fprint(w, page.body)
+	}))
+	defer server.Close()
+
+	f, err := newGitLabForge(server.URL, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments, err := f.IssueComments(context.Background(), &forgeRepo{ID: 7}, since)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Notes from before since and system notes are left out, the rest
+	// come oldest first.
+	want := []struct {
+		id    int64
+		issue int
+	}{{21, 2}, {11, 1}, {22, 2}}
+	if len(comments) != len(want) {
+		t.Fatalf("got %d comments, want %d", len(comments), len(want))
+	}
+	for i, c := range comments {
+		if c.ID != want[i].id || c.Issue != want[i].issue || c.Author != "alice" {
+			t.Errorf("comment %d: got %+v, want ID %d on issue %d by alice", i, c, want[i].id, want[i].issue)
+		}
+	}
+}
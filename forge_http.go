@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpError is returned by restClient for any response with a 4xx or 5xx
+// status.
+type httpError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Message    string
+	// RetryAfter is set from the Retry-After header, if there was one.
+	RetryAfter time.Duration
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, e.Message)
+}
+
+// restClient is a minimal JSON API client shared by the Gitea and GitLab
+// forges.
+type restClient struct {
+	baseURL *url.URL
+	// header and value used to authenticate each request.
+	authHeader string
+	authValue  string
+	client     *http.Client
+}
+
+func newRESTClient(baseURL, authHeader, authValue string) (*restClient, error) {
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse provided url: %v", err)
+	}
+	return &restClient{
+		baseURL:    u,
+		authHeader: authHeader,
+		authValue:  authValue,
+		client:     &http.Client{Timeout: time.Minute, Transport: &instrumentedTransport{next: http.DefaultTransport}},
+	}, nil
+}
+
+// do sends body as JSON to path and decodes the response into out, which
+// may be nil.
+func (c *restClient) do(ctx context.Context, method, path string, body, out interface{}) (*http.Response, error) {
+	u, err := c.baseURL.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, u.String(), r)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.authValue != "" {
+		req.Header.Set(c.authHeader, c.authValue)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		e := &httpError{
+			Method:     method,
+			URL:        u.String(),
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(b)),
+		}
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			e.RetryAfter = time.Duration(secs) * time.Second
+		}
+		return resp, e
+	}
+
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil && err != io.EOF {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+// escapePath escapes every segment of a file path but keeps the slashes.
+func escapePath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+// forkRecord links an upstream repository to the bot's fork of it. Both
+// sides are tracked by ID so renames, transfers and GitHub picking a
+// different name for the fork do not break the link.
+type forkRecord struct {
+	UpstreamID   int64     `json:"upstream_id"`
+	UpstreamName string    `json:"upstream_name"`
+	ForkID       int64     `json:"fork_id"`
+	ForkName     string    `json:"fork_name"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// lookupFork returns the registered fork of the upstream repo with the
+// given ID.
+func (s *stateStore) lookupFork(upstreamID int64) (forkRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.Forks[upstreamID]
+	if !ok {
+		return forkRecord{}, false
+	}
+	return *rec, true
+}
+
+// registerFork records fork as the bot's fork of upstream, updating the
+// names if either side was renamed.
+func (s *stateStore) registerFork(upstream, fork *forgeRepo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Forks[upstream.ID] = &forkRecord{
+		UpstreamID:   upstream.ID,
+		UpstreamName: upstream.FullName(),
+		ForkID:       fork.ID,
+		ForkName:     fork.FullName(),
+		UpdatedAt:    time.Now().UTC(),
+	}
+	return s.save()
+}
+
+// forgetFork drops the registry entry for an upstream repo.
+func (s *stateStore) forgetFork(upstreamID int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.Forks, upstreamID)
+	return s.save()
+}
+
+// isForkOf reports whether fork was forked from the repo with upstreamID.
+func isForkOf(fork *github.Repository, upstreamID int64) bool {
+	return fork.GetFork() && fork.GetParent().GetID() == upstreamID
+}
+
+// resolveFork looks up the bot's existing fork of upstream by ID. It
+// returns nil if no fork is registered, or if the registered one was
+// deleted or is no longer a fork of upstream, and the attempts made.
+func resolveFork(ctx context.Context, client *github.Client, upstream *github.Repository) (*github.Repository, int, error) {
+	if upstream.GetID() == 0 {
+		return nil, 0, nil
+	}
+	rec, ok := state.lookupFork(upstream.GetID())
+	if !ok {
+		return nil, 0, nil
+	}
+
+	var fork *github.Repository
+	attempts, err := retry(ctx, stageFork, func() error {
+		var err error
+		fork, _, err = client.Repositories.GetByID(ctx, rec.ForkID)
+		return err
+	})
+	if resp, ok := err.(*github.ErrorResponse); ok && resp.Response != nil && resp.Response.StatusCode == http.StatusNotFound {
+		logrus.Infof("Registered fork %s of %s is gone", rec.ForkName, rec.UpstreamName)
+		return nil, attempts, state.forgetFork(upstream.GetID())
+	}
+	if err != nil {
+		return nil, attempts, err
+	}
+
+	if !isForkOf(fork, upstream.GetID()) {
+		logrus.Warnf("Registered fork %s is no longer a fork of %s", fork.GetFullName(), upstream.GetFullName())
+		return nil, attempts, state.forgetFork(upstream.GetID())
+	}
+
+	if fork.GetFullName() != rec.ForkName || upstream.GetFullName() != rec.UpstreamName {
+		logrus.Infof("Fork of %s moved from %s to %s", upstream.GetFullName(), rec.ForkName, fork.GetFullName())
+		if err := state.registerFork(fromGitHubRepo(upstream), fromGitHubRepo(fork)); err != nil {
+			return nil, attempts, err
+		}
+	}
+	return fork, attempts, nil
+}
+
+// resolveForgeFork is resolveFork for the forges other than GitHub, which
+// look up a repository by ID with get.
+func resolveForgeFork(ctx context.Context, upstream *forgeRepo, get func(id int64) (*forgeRepo, error)) (*forgeRepo, int, error) {
+	if upstream.ID == 0 {
+		return nil, 0, nil
+	}
+	rec, ok := state.lookupFork(upstream.ID)
+	if !ok {
+		return nil, 0, nil
+	}
+
+	var fork *forgeRepo
+	attempts, err := retry(ctx, stageFork, func() error {
+		var err error
+		fork, err = get(rec.ForkID)
+		return err
+	})
+	if errorStatus(err) == http.StatusNotFound {
+		logrus.Infof("Registered fork %s of %s is gone", rec.ForkName, rec.UpstreamName)
+		return nil, attempts, state.forgetFork(upstream.ID)
+	}
+	if err != nil {
+		return nil, attempts, err
+	}
+
+	if fork.Parent == nil || fork.Parent.ID != upstream.ID {
+		logrus.Warnf("Registered fork %s is no longer a fork of %s", fork.FullName(), upstream.FullName())
+		return nil, attempts, state.forgetFork(upstream.ID)
+	}
+
+	if fork.FullName() != rec.ForkName || upstream.FullName() != rec.UpstreamName {
+		logrus.Infof("Fork of %s moved from %s to %s", upstream.FullName(), rec.ForkName, fork.FullName())
+		if err := state.registerFork(upstream, fork); err != nil {
+			return nil, attempts, err
+		}
+	}
+	return fork, attempts, nil
+}
+
+// warnStaleFork warns when the default branch of fork is not at the head of
+// the upstream default branch. Only GitHub forks are synced with upstream,
+// elsewhere the fix is committed on top of the fork as it is.
+func warnStaleFork(ctx context.Context, f forge, upstream, fork *forgeRepo) {
+	head, err := f.Commits(ctx, upstream, upstream.DefaultBranch, 1)
+	if err != nil || len(head) == 0 {
+		logrus.Debugf("getting the head of %s failed: %v", upstream.FullName(), err)
+		return
+	}
+	forkHead, err := f.Commits(ctx, fork, fork.DefaultBranch, 1)
+	if err != nil || len(forkHead) == 0 {
+		logrus.Debugf("getting the head of %s failed: %v", fork.FullName(), err)
+		return
+	}
+	if head[0].SHA != forkHead[0].SHA {
+		logrus.Warnf("Fork %s is not in sync with %s, the fix is based on the fork as it is. Sync or delete the fork to base it on upstream.", fork.FullName(), upstream.FullName())
+	}
+}
+
+// getForkByID fetches a fork by ID and makes sure it still belongs to the
+// upstream repo with upstreamID. A 404 is retryable since GitHub creates
+// forks in the background.
+func getForkByID(ctx context.Context, client *github.Client, forkID, upstreamID int64) (*github.Repository, int, error) {
+	var fork *github.Repository
+	attempts, err := retry(ctx, stageForkReady, func() error {
+		result, resp, err := client.Repositories.GetByID(ctx, forkID)
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			// GitHub has not finished creating the fork yet.
+			logrus.Debugf("Sleeping on fork %d", forkID)
+			return retryableError{err}
+		}
+		if err != nil {
+			return err
+		}
+		fork = result
+		return nil
+	})
+	if err != nil {
+		return nil, attempts, err
+	}
+
+	if !isForkOf(fork, upstreamID) {
+		return nil, attempts, fmt.Errorf("repository %d (%s) is not a fork of upstream %d", forkID, fork.GetFullName(), upstreamID)
+	}
+	return fork, attempts, nil
+}
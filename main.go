@@ -4,15 +4,17 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/azillion/golint-fixer/version"
+	"github.com/azillion/ghb0t/version"
 	"github.com/blang/semver"
 	"github.com/genuinetools/pkg/cli"
 	"github.com/google/go-github/github"
@@ -21,30 +23,58 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
+const searchQuery = "github.com/golang/lint/golint filename:.travis.yml"
+
 // Travis struct to unmarshal .travis.yml files
 type Travis struct {
 	GoVersions []string `yaml:"go,flow"`
 }
 
 var (
-	token    string
-	interval time.Duration
-	enturl   string
+	token     string
+	interval  time.Duration
+	enturl    string
+	statePath string
+
+	forgeType string
+	repoName  string
+	reposFile string
+	owner     string
+
+	metricsAddr   string
+	dashboardAddr string
+	adminAddr     string
+	adminToken    string
+	controlRepo   string
+	controlTeam   string
+	logFormat     string
+	auditPath     string
+
+	autoMergeOrgs string
+	templatesDir  string
+
+	authorName     string
+	authorEmail    string
+	committerName  string
+	committerEmail string
+
+	signingKey    string
+	signingFormat string
+
+	campaignName string
+
+	// botLogin is the login of the user the bot runs as.
+	botLogin string
+
+	state *stateStore
 
 	lastChecked time.Time
 
-	debug          bool
-	validGoVersion semver.Version
-	pageStart      int
-)
+	campaignsPath string
 
-func init() {
-	v, err := semver.ParseTolerant("1.10")
-	if err != nil {
-		logrus.Fatal(err)
-	}
-	validGoVersion = v
-}
+	debug     bool
+	pageStart int
+)
 
 func main() {
 	// Create a new cli program.
@@ -56,11 +86,46 @@ func main() {
 	p.GitCommit = version.GITCOMMIT
 	p.Version = version.VERSION
 
+	// Build the list of available commands.
+	p.Commands = []cli.Command{
+		&applyCommand{},
+		&explainCommand{},
+		&failedCommand{},
+		&planCommand{},
+		&renderCommand{},
+		&reportCommand{},
+		&surveyCommand{},
+	}
+
 	// Setup the global flags.
 	p.FlagSet = flag.NewFlagSet("global", flag.ExitOnError)
 	p.FlagSet.StringVar(&token, "token", os.Getenv("GITHUB_TOKEN"), "GitHub API token (or env var GITHUB_TOKEN)")
 	p.FlagSet.DurationVar(&interval, "interval", 30*time.Second, "check interval (ex. 5ms, 10s, 1m, 3h)")
 	p.FlagSet.StringVar(&enturl, "url", "", "Connect to a specific GitHub server, provide full API URL (ex. https://github.example.com/api/v3/)")
+	p.FlagSet.StringVar(&forgeType, "forge", "github", "forge to talk to: github, gitea, forgejo or gitlab (-url is the API URL, ex. https://gitea.example.com/api/v1/), only GitHub forks are synced with upstream")
+	p.FlagSet.StringVar(&statePath, "state", filepath.Join(os.Getenv("HOME"), ".golint-fixer", "state.json"), "path to the state file")
+
+	p.FlagSet.StringVar(&repoName, "repo", "", "only process a single repository (ex. owner/name)")
+	p.FlagSet.StringVar(&reposFile, "repos-file", "", "read repositories from a file of owner/name or JSON lines, - for stdin")
+	p.FlagSet.StringVar(&owner, "owner", "", "process every repository of a user or organization")
+	p.FlagSet.StringVar(&authorName, "author-name", "", "name to author commits as (defaults to the bot's login)")
+	p.FlagSet.StringVar(&authorEmail, "author-email", "", "email to author commits as, needed for DCO sign-offs")
+	p.FlagSet.StringVar(&committerName, "committer-name", "", "name to commit as (defaults to the author)")
+	p.FlagSet.StringVar(&committerEmail, "committer-email", "", "email to commit as (defaults to the author)")
+	p.FlagSet.StringVar(&signingKey, "signing-key", "", "OpenPGP or SSH private key to sign commits with (passphrase in env var SIGNING_KEY_PASSPHRASE)")
+	p.FlagSet.StringVar(&signingFormat, "signing-format", "", "format of -signing-key: openpgp or ssh (detected from the key by default)")
+	p.FlagSet.StringVar(&campaignName, "campaign", "", "campaign recorded in the Fixer-Campaign trailer of every commit, or the one of -campaigns a command works on (ex. 2026-lint)")
+	p.FlagSet.StringVar(&campaignsPath, "campaigns", "", "YAML file of campaigns to run side by side instead of the one the flags describe (SIGHUP reloads their status)")
+	p.FlagSet.StringVar(&templatesDir, "templates", "", "directory with <rule>/title.tmpl, body.tmpl and commit.tmpl overriding the built in templates")
+	p.FlagSet.StringVar(&logFormat, "log-format", "text", "log format: text or json")
+	p.FlagSet.StringVar(&auditPath, "audit-log", filepath.Join(os.Getenv("HOME"), ".golint-fixer", "audit.jsonl"), "append a JSON line per decision and side effect to this file, empty to disable")
+	p.FlagSet.StringVar(&metricsAddr, "metrics-addr", "", "serve Prometheus metrics on this address (ex. :9090)")
+	p.FlagSet.StringVar(&dashboardAddr, "dashboard-addr", "", "serve the web dashboard on this address (ex. localhost:8080)")
+	p.FlagSet.StringVar(&adminAddr, "admin-addr", "", "serve the admin API on this address (ex. localhost:8081), keeps campaigns without an interval waiting for a rescan")
+	p.FlagSet.StringVar(&adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token the admin API and dashboard retries require (or env var ADMIN_TOKEN)")
+	p.FlagSet.StringVar(&controlRepo, "control-repo", "", "take slash commands from the issue comments of this repository (owner/repo), keeps campaigns without an interval waiting for a rescan")
+	p.FlagSet.StringVar(&controlTeam, "control-team", "", "only take commands from members of this team (org/team, or a group path on GitLab)")
+	p.FlagSet.StringVar(&autoMergeOrgs, "automerge", "", "merge PRs once checks pass in these orgs, comma separated (ex. myorg,golint-import:otherorg)")
 
 	p.FlagSet.BoolVar(&debug, "d", false, "enable debug logging")
 	p.FlagSet.IntVar(&pageStart, "p", 1, "page to start on")
@@ -71,11 +136,65 @@ func main() {
 		if debug {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+		switch logFormat {
+		case "text":
+		case "json":
+			logrus.SetFormatter(&logrus.JSONFormatter{})
+		default:
+			return fmt.Errorf("unknown log format %q, must be text or json", logFormat)
+		}
 
 		if token == "" {
 			return fmt.Errorf("GitHub token cannot be empty")
 		}
 
+		if err := parseAutoMerge(autoMergeOrgs); err != nil {
+			return err
+		}
+		if adminAddr != "" && adminToken == "" {
+			return fmt.Errorf("-admin-addr needs -admin-token, the admin API is never served without one")
+		}
+		if controlRepo != "" && controlTeam == "" {
+			return fmt.Errorf("-control-repo needs -control-team, commands are never taken from just anyone")
+		}
+		if signingKey != "" && authorEmail == "" {
+			return fmt.Errorf("-signing-key needs -author-email, signed commits must name their author")
+		}
+		if templatesDir != "" {
+			if err := loadTemplates(templatesDir, rules); err != nil {
+				return fmt.Errorf("loading templates failed: %v", err)
+			}
+		}
+		for _, r := range rules {
+			r.campaign = campaignName
+		}
+
+		var err error
+		state, err = openStateStore(statePath)
+		if err != nil {
+			return fmt.Errorf("opening state file %s failed: %v", statePath, err)
+		}
+
+		if campaignsPath != "" {
+			campaigns, err = loadCampaigns(campaignsPath)
+			if err != nil {
+				return fmt.Errorf("loading campaigns from %s failed: %v", campaignsPath, err)
+			}
+		} else {
+			c, err := defaultCampaign()
+			if err != nil {
+				return err
+			}
+			campaigns = []*campaign{c}
+		}
+
+		if auditPath != "" {
+			audit, err = openAuditLog(auditPath)
+			if err != nil {
+				return fmt.Errorf("opening audit log %s failed: %v", auditPath, err)
+			}
+		}
+
 		return nil
 	}
 
@@ -87,6 +206,8 @@ func main() {
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt)
 		signal.Notify(c, syscall.SIGTERM)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithCancel(ctx)
 		go func() {
@@ -97,45 +218,45 @@ func main() {
 				os.Exit(0)
 			}
 		}()
-
-		// Create the http client.
-		ts := oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: token},
-		)
-		tc := oauth2.NewClient(ctx, ts)
-
-		// Create the github client.
-		client := github.NewClient(tc)
-		if enturl != "" {
-			var err error
-			client.BaseURL, err = url.Parse(enturl)
-			if err != nil {
-				logrus.Fatalf("failed to parse provided url: %v", err)
+		go func() {
+			for range hup {
+				if campaignsPath == "" {
+					continue
+				}
+				logrus.Infof("Reloading campaigns from %s", campaignsPath)
+				if err := reloadCampaigns(campaignsPath); err != nil {
+					logrus.Errorf("reloading campaigns failed: %v", err)
+				}
 			}
+		}()
+
+		if metricsAddr != "" {
+			go serveMetrics(metricsAddr)
+		}
+		if adminAddr != "" {
+			go serveAdmin(adminAddr, adminToken)
 		}
 
-		// Get the authenticated user, the empty string being passed let's the GitHub
-		// API know we want ourself.
-		user, _, err := client.Users.Get(ctx, "")
+		f, err := connectForge(ctx)
 		if err != nil {
 			logrus.Fatal(err)
 		}
-		username := *user.Login
 
-		logrus.Infof("Bot started for user %s.", username)
+		if dashboardAddr != "" {
+			go serveDashboard(dashboardAddr, adminToken)
+		}
+		if controlRepo != "" {
+			go watchControlRepo(ctx, f, controlRepo, controlTeam)
+		}
 
-		reposChan := make(chan github.Repository, 2)
-		forksChan := make(chan github.Repository, 2)
+		logrus.Infof("Bot started for user %s on %s.", botLogin, f.Name())
 
 		var wg sync.WaitGroup
-		wg.Add(2)
-		go getSearchResults(ctx, client, pageStart, reposChan, &wg)
-		go handleRepos(ctx, client, reposChan, forksChan, &wg)
-		for fork := range forksChan {
+		for _, c := range campaigns {
 			wg.Add(1)
-			go handleForks(ctx, client, &fork, &wg)
-			time.Sleep(3 * time.Second)
+			go c.run(ctx, f, &wg)
 		}
+		markReady()
 		wg.Wait()
 
 		// ¯\_(ツ)_/¯
@@ -148,80 +269,220 @@ func main() {
 	p.Run()
 }
 
-func getSearchResults(ctx context.Context, client *github.Client, page int, repos chan<- github.Repository, wg *sync.WaitGroup) {
-	defer close(repos)
+// newGitHubClient creates a GitHub client authenticated with the token and
+// pointed at the enterprise URL, if one was given.
+func newGitHubClient(ctx context.Context) (*github.Client, error) {
+	// Create the http client.
+	ts := oauth2.StaticTokenSource(
+		&oauth2.Token{AccessToken: token},
+	)
+	tc := oauth2.NewClient(ctx, ts)
+	tc.Transport = &instrumentedTransport{next: tc.Transport}
+
+	// Create the github client.
+	client := github.NewClient(tc)
+	if enturl != "" {
+		var err error
+		client.BaseURL, err = url.Parse(enturl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse provided url: %v", err)
+		}
+	}
+	return client, nil
+}
+
+// connectForge creates the forge and looks up the bot's own login.
+func connectForge(ctx context.Context) (forge, error) {
+	f, err := newForge(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the authenticated user.
+	botLogin, err = f.User(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// runPipeline forks and fixes every repository sent by produce for c.
+// produce must close targets and call wg.Done when it is finished.
+func runPipeline(ctx context.Context, f forge, c *campaign, produce func(targets chan<- *fixTarget, wg *sync.WaitGroup)) {
+	targetsChan := make(chan *fixTarget, 2)
+	forksChan := make(chan *fixTarget, 2)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go produce(targetsChan, &wg)
+	go handleRepos(ctx, f, c, targetsChan, forksChan, &wg)
+	for target := range forksChan {
+		wg.Add(1)
+		go handleForks(ctx, f, c, target, &wg)
+		time.Sleep(c.pace())
+	}
+	wg.Wait()
+}
+
+// discoverRepos sends every eligible repository found by the source of c
+// to the pipeline, holding off while c is paused.
+func discoverRepos(ctx context.Context, f forge, c *campaign, targets chan<- *fixTarget, wg *sync.WaitGroup) {
+	defer close(targets)
 	defer wg.Done()
-	opts := &github.SearchOptions{Sort: "indexed", Order: "asc", ListOptions: github.ListOptions{Page: page}}
-	for {
-		results, resp, err := client.Search.Code(ctx, "github.com/golang/lint/golint filename:.travis.yml", opts)
-		if _, ok := err.(*github.RateLimitError); ok {
-			logrus.Fatal("hit rate limit")
-			return
+
+	src := c.src
+	logrus.Debugf("Discovering repositories from %s", src.Name())
+	found := 0
+	err := src.Repos(ctx, f, func(repo *forgeRepo) bool {
+		if !c.wait(ctx) {
+			return false
 		}
-		if err != nil {
-			logrus.Fatal(err)
-			return
+		found++
+		reposDiscovered.inc(src.Name())
+		audit.record(auditEvent{Event: eventDiscovered, Repo: repo.FullName(), Source: src.Name()})
+		if r := isEligible(ctx, f, c, repo); r != nil {
+			targets <- &fixTarget{upstream: repo, rule: r}
+			logrus.Debugf("sent %s to be forked", repo.Name)
 		}
-		// logrus.Infof("Total Search Results: %v", results.GetTotal())
+		return ctx.Err() == nil
+	})
+	e := auditEvent{Event: eventSearched, Source: src.Name(), Count: found}
+	if err != nil {
+		logrus.Errorf("discovering repositories from %s failed: %v", src.Name(), err)
+		e.Error = err.Error()
+	}
+	audit.record(e)
+}
 
-		for _, cr := range results.CodeResults {
-			repo := cr.GetRepository()
-			fileContent, _, _, err := getFileContent(ctx, client, repo)
-			if _, ok := err.(*github.RateLimitError); ok {
-				logrus.Fatal("hit rate limit")
-				return
-			}
-			if err != nil {
-				continue
-			}
+// isEligible returns the first rule of c the bot should open a PR for
+// against repo, or nil if there is none. Skips are noted and failed lookups
+// recorded.
+func isEligible(ctx context.Context, f forge, c *campaign, repo *forgeRepo) *rule {
+	r, kind, reason, err := checkEligible(ctx, f, c, repo)
+	if err != nil {
+		stage, attempts, err := errorStage(err, stageDuplicate)
+		c.recordFailure(repo.FullName(), stage, attempts, err)
+		return nil
+	}
+	if r == nil {
+		noteSkip(repo.FullName(), kind, reason)
+	}
+	return r
+}
 
-			// check file contains github.com/golang/lint/golint
-			if strings.Contains(fileContent, "github.com/golang/lint/golint") == false {
-				continue
-			}
+// checkEligible returns the first rule of c the bot should open a PR for
+// against repo. When there is none it returns the kind of skip and why. It
+// only reads from the forge, so plan can use it too.
+func checkEligible(ctx context.Context, f forge, c *campaign, repo *forgeRepo) (*rule, string, string, error) {
+	if state.denied(repo.Owner) {
+		return nil, "denylisted", fmt.Sprintf("%s is on the denylist", repo.Owner), nil
+	}
 
-			// check if repo is archived
-			if repo.GetArchived() {
-				continue
-			}
+	matched, files, kind, reason := matchRule(ctx, f, c, repo)
+	if matched == nil {
+		return nil, kind, reason, nil
+	}
 
-			// check for a valid go version
-			// if ok := checkValidGoVersion([]byte(fileContent)); ok == false {
-			// 	continue
-			// }
+	// check if repo is archived
+	if repo.Archived {
+		return nil, "archived", "repository is archived", nil
+	}
 
-			// check that golint-fixer hasn't already opened a PR
-			openPRsFiltered, _, err := client.PullRequests.List(ctx, repo.GetOwner().GetLogin(), repo.GetName(), &github.PullRequestListOptions{State: "all", Head: "golint-fixer:master"})
-			if _, ok := err.(*github.RateLimitError); ok {
-				logrus.Fatal("hit rate limit")
-				return
-			}
+	// check for a valid go version
+	if travis := files[".travis.yml"]; travis != nil && !c.policy.allowsGoVersions(travis.Content) {
+		return nil, "old-go", fmt.Sprintf("builds with Go older than %s", c.policy.MinGoVersion), nil
+	}
+
+	// check that golint-fixer hasn't already opened a PR
+	opened, attempts, err := hasBotPullRequest(ctx, f, c, repo)
+	if err != nil {
+		return nil, "", "", &stageError{stageDuplicate, attempts, err}
+	}
+	if opened {
+		return nil, "has-pr", "bot already opened a PR", nil
+	}
+
+	// if PR has not already been opened/closed
+	return matched, "", "", nil
+}
+
+// matchRule returns the first rule of c whose file in repo contains what
+// it rewrites, along with the files read on the way. When no rule matches
+// it returns the kind of skip and why each rule failed.
+func matchRule(ctx context.Context, f forge, c *campaign, repo *forgeRepo) (*rule, map[string]*forgeFile, string, string) {
+	files := map[string]*forgeFile{}
+	kind, reasons := "no-file", []string{}
+	for _, r := range c.rules {
+		file, ok := files[r.Path]
+		if !ok {
+			var err error
+			file, err = getFileContent(ctx, f, repo, r.Path, "")
 			if err != nil {
-				continue
+				reasons = append(reasons, fmt.Sprintf("reading %s failed: %v", r.Path, err))
 			}
+			files[r.Path] = file
+		}
+		if file == nil {
+			continue
+		}
 
-			// if PR has not already been opened/closed
-			if len(openPRsFiltered) == 0 {
-				repos <- *cr.GetRepository()
-				logrus.Debugf("sent %s to be forked", repo.GetName())
-			}
+		// check file contains what the rule rewrites
+		if !r.matches(file.Content) {
+			kind = "no-match"
+			reasons = append(reasons, fmt.Sprintf("%s does not contain %s", r.Path, r.Old))
+			continue
 		}
+		return r, files, "", ""
+	}
+	return nil, files, kind, strings.Join(reasons, "; ")
+}
 
-		if resp.NextPage == 0 {
-			break
+// hasBotPullRequest reports whether c has already opened (or had closed) a
+// PR against repo, from its fork or from a direct branch, and the attempts
+// made at the lookup that failed.
+func hasBotPullRequest(ctx context.Context, f forge, c *campaign, repo *forgeRepo) (bool, int, error) {
+	var heads []string
+	for _, r := range c.rules {
+		heads = append(heads, botLogin+":"+c.forkBranch(r, repo), repo.Owner+":"+c.directBranch(r))
+	}
+	seen := map[string]bool{}
+	attempts := 0
+	for _, head := range heads {
+		if seen[head] {
+			continue
 		}
+		seen[head] = true
 
-		opts.Page = resp.NextPage
-		logrus.Debugf("Going to page %d", resp.NextPage)
-		// to stay within search rate limit
-		time.Sleep(4 * time.Second)
+		var prs []*forgePR
+		var err error
+		attempts, err = retry(ctx, stageDuplicate, func() error {
+			var err error
+			prs, err = f.ListPRs(ctx, repo, head)
+			return err
+		})
+		if err != nil {
+			return false, attempts, err
+		}
+		if len(prs) > 0 {
+			return true, attempts, nil
+		}
 	}
-	logrus.Debug("Done searching!")
-	return
+	return false, attempts, nil
 }
 
-// unused
-func checkValidGoVersion(travisFile []byte) bool {
+// travisGoVersions returns the Go versions a Travis file builds with, or
+// nil if it can't be parsed.
+func travisGoVersions(content string) []string {
+	travisYML := Travis{}
+	if err := yaml.Unmarshal([]byte(content), &travisYML); err != nil {
+		return nil
+	}
+	return travisYML.GoVersions
+}
+
+// checkValidGoVersion reports whether every Go version in travisFile is at
+// least min.
+func checkValidGoVersion(travisFile []byte, min semver.Version) bool {
 	travisYML := Travis{}
 
 	err := yaml.Unmarshal(travisFile, &travisYML)
@@ -235,174 +496,331 @@ func checkValidGoVersion(travisFile []byte) bool {
 		if err != nil {
 			return false
 		}
-		if validGoVersion.GT(ver) {
+		if min.GT(ver) {
 			return false
 		}
 	}
 	return true
 }
 
-func handleRepos(ctx context.Context, client *github.Client, repos <-chan github.Repository, forks chan<- github.Repository, wg *sync.WaitGroup) {
+func handleRepos(ctx context.Context, f forge, c *campaign, targets <-chan *fixTarget, forks chan<- *fixTarget, wg *sync.WaitGroup) {
 	defer wg.Done()
 	defer close(forks)
 	var wg2 sync.WaitGroup
 
 	// create the fork
-	for repo := range repos {
+	for t := range targets {
 		wg2.Add(1)
-		logrus.Debugf("creating fork for %s", repo.GetName())
-		go createFork(ctx, client, repo, forks, &wg2)
+		logrus.Debugf("creating fork for %s", t.upstream.Name)
+		go createFork(ctx, f, c, t, forks, &wg2)
 	}
 
 	wg2.Wait()
 }
 
-func createFork(ctx context.Context, client *github.Client, repo github.Repository, forks chan<- github.Repository, wg *sync.WaitGroup) {
+func createFork(ctx context.Context, f forge, c *campaign, t *fixTarget, forks chan<- *fixTarget, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	result, _, err := client.Repositories.CreateFork(ctx, repo.GetOwner().GetLogin(), repo.GetName(), new(github.RepositoryCreateForkOptions))
-	if _, ok := err.(*github.RateLimitError); ok {
-		logrus.Fatal("hit rate limit")
+	// Search results are partial, so get the full repo including our
+	// permissions on it.
+	repo, attempts, err := fetchRepo(ctx, f, t.upstream.FullName())
+	if err != nil {
+		c.recordFailure(t.upstream.FullName(), stageUpstreamCheck, attempts, err)
 		return
 	}
-	if _, ok := err.(*github.AcceptedError); ok {
-		// logrus.Debugf("Sleeping after fork creation of %s", repo.GetName())
-		time.Sleep(2 * time.Second)
-		forks <- *result
+	if kind, reason := c.policy.allowsRepo(repo); kind != "" {
+		c.recordSkip(repo.FullName(), kind, reason)
 		return
 	}
+
+	// The search index can lag behind by months, so make sure the default
+	// branch still needs the fix before we fork anything.
+	needed, attempts, err := upstreamNeedsFix(ctx, f, repo, t.rule)
 	if err != nil {
-		logrus.Error(err)
+		c.recordFailure(repo.FullName(), stageUpstreamCheck, attempts, err)
+		return
+	}
+	if !needed {
+		c.recordSkip(repo.FullName(), "fixed-upstream", fmt.Sprintf("%s already fixed upstream", t.rule.Path))
 		return
 	}
-}
-
-func handleForks(ctx context.Context, client *github.Client, repo *github.Repository, wg *sync.WaitGroup) {
-	defer wg.Done()
 
-	// verify that the forked repo is fully created
-	for i := 0; i < 4; i++ {
-		result, _, err := client.Repositories.Get(ctx, repo.GetOwner().GetLogin(), repo.GetName())
-		if _, ok := err.(*github.RateLimitError); ok {
-			logrus.Fatal("hit rate limit")
+	// No need for a fork if we can push a branch to the repo itself.
+	if repo.CanPush {
+		branch := c.directBranch(t.rule)
+		attempts, err := retry(ctx, stageBranch, func() error {
+			return f.CreateBranch(ctx, repo, branch)
+		})
+		if err != nil {
+			c.recordFailure(repo.FullName(), stageBranch, attempts, err)
 			return
 		}
-		if err == nil {
-			repo = result
-			break
+		repoLog(repo.FullName()).Debugf("pushing directly to %s", branch)
+		audit.record(auditEvent{Event: eventBranched, Repo: repo.FullName(), Reason: branch})
+		forks <- &fixTarget{upstream: repo, head: repo, branch: branch, rule: t.rule, planned: t.planned}
+		return
+	}
+
+	fork, err := f.Fork(ctx, repo)
+	if err != nil {
+		stage, attempts, err := errorStage(err, stageFork)
+		c.recordFailure(repo.FullName(), stage, attempts, err)
+		return
+	}
+	forksCreated.inc()
+	audit.record(auditEvent{Event: eventForked, Repo: repo.FullName(), URL: fork.HTMLURL})
+
+	// Campaigns keep their fixes apart on branches of their own, so they
+	// can share a fork.
+	branch := c.forkBranch(t.rule, fork)
+	if branch != fork.DefaultBranch {
+		attempts, err := retry(ctx, stageBranch, func() error {
+			return f.CreateBranch(ctx, fork, branch)
+		})
+		if err != nil {
+			c.recordFailure(repo.FullName(), stageBranch, attempts, err)
+			return
 		}
-		logrus.Debugf("Sleeping on %s", repo.GetName())
-		time.Sleep(30 * time.Second)
 	}
+	forks <- &fixTarget{upstream: repo, head: fork, branch: branch, rule: t.rule, planned: t.planned}
+}
+
+func handleForks(ctx context.Context, f forge, c *campaign, t *fixTarget, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	upstream := t.upstream.FullName()
+	r := t.rule
 
-	// get .travis.yml
-	fileContent, file, repo, err := getFileContent(ctx, client, repo)
+	// get the file the rule rewrites
+	file, attempts, err := fetchFile(ctx, f, t.head, r.Path, t.branch)
 	if err != nil {
-		logrus.Error(err)
+		c.recordFailure(upstream, stageContent, attempts, err)
+		return
+	}
+	if sha, ok := t.planned[file.Path]; ok && sha != file.SHA {
+		c.recordSkip(upstream, "plan-stale", fmt.Sprintf("%s changed since the plan was made", file.Path))
 		return
 	}
 
 	// replace with correct path
-	fixedFile := strings.Replace(fileContent, "github.com/golang/lint/golint", "golang.org/x/lint/golint", -1)
-	err = createCommit(ctx, client, repo, file, fixedFile)
-	if _, ok := err.(*github.RateLimitError); ok {
-		logrus.Fatal("hit rate limit")
+	fixedFile, changed := r.apply(file.Content)
+	if !changed {
+		c.recordSkip(upstream, "no-changes", fmt.Sprintf("%s in the fork needs no changes", r.Path))
 		return
 	}
+	msg, err := r.render(t.upstream, []fileChange{newFileChange(file.Path, file.Content, fixedFile)})
 	if err != nil {
-		logrus.Error(err)
+		c.recordFailure(upstream, stageCommit, 1, fmt.Errorf("rendering templates failed: %v", err))
+		return
+	}
+	followConventions(ctx, f, t.upstream, r, msg)
+	signOff(ctx, f, t.upstream, msg)
+	if attempts, err := createCommit(ctx, f, t, file, fixedFile, msg.Commit); err != nil {
+		c.recordFailure(upstream, stageCommit, attempts, err)
 		return
 	}
 
 	// create PR
-	err = createPullRequest(ctx, client, repo)
+	pr, attempts, err := createPullRequest(ctx, f, t, msg)
 	if err != nil {
-		logrus.Error(err)
+		c.recordFailure(upstream, stagePullRequest, attempts, err)
 		return
 	}
+
+	// We can only ask for reviews on repos we have push access to.
+	if t.direct() {
+		users, teams := codeownersReviewers(ctx, f, t.upstream, t.branch, []string{file.Path})
+		if len(users) > 0 || len(teams) > 0 {
+			if err := f.RequestReviewers(ctx, t.upstream, pr, users, teams); err != nil {
+				logrus.Warnf("requesting reviewers on %s failed: %v", pr.URL, err)
+			}
+		}
+	}
+
+	diff := unifiedDiff(file.Path, file.Content, fixedFile)
+	if err := c.state.recordPR(upstream, pr, parseTrailers(msg.Commit), diff); err != nil {
+		logrus.Warnf("saving PR for %s failed: %v", upstream, err)
+	}
+	info := &repoInfo{Stars: t.upstream.Stars}
+	if r.Path == ".travis.yml" {
+		info.GoVersions = travisGoVersions(file.Content)
+	} else if travis, err := getFileContent(ctx, f, t.upstream, ".travis.yml", ""); err == nil {
+		info.GoVersions = travisGoVersions(travis.Content)
+	}
+	if err := c.state.recordRepoInfo(upstream, info); err != nil {
+		logrus.Warnf("saving repo info for %s failed: %v", upstream, err)
+	}
+	wg.Add(1)
+	go watchChecks(ctx, f, c.state, t.upstream, pr, wg)
+
+	if r.autoMerges(t.upstream.Owner) {
+		wg.Add(1)
+		go autoMerge(ctx, f, c, t.upstream, pr, wg)
+	}
+	if err := c.state.recordStage(upstream, stagePullRequest); err != nil {
+		logrus.Warnf("saving state for %s failed: %v", upstream, err)
+	}
 }
 
-func getFileContent(ctx context.Context, client *github.Client, repo *github.Repository) (string, *github.RepositoryContent, *github.Repository, error) {
-	file, _, _, err := client.Repositories.GetContents(ctx, repo.GetOwner().GetLogin(), repo.GetName(), ".travis.yml", new(github.RepositoryContentGetOptions))
-	if _, ok := err.(*github.RateLimitError); ok {
-		logrus.Fatal("hit rate limit")
-		return "", nil, nil, err
+// upstreamNeedsFix evaluates r against the default branch of the upstream
+// repo and reports whether applying it produces a non-empty diff, and the
+// attempts made at reading the file.
+func upstreamNeedsFix(ctx context.Context, f forge, repo *forgeRepo, r *rule) (bool, int, error) {
+	file, attempts, err := fetchFile(ctx, f, repo, r.Path, repo.DefaultBranch)
+	if errorStatus(err) == http.StatusNotFound {
+		// The file is gone, so there is nothing left to fix.
+		return false, attempts, nil
 	}
 	if err != nil {
-		return "", nil, nil, err
+		return false, attempts, err
 	}
 
-	fileContent, err := file.GetContent()
+	_, changed := r.apply(file.Content)
+	return changed, attempts, nil
+}
+
+// recordSkip logs why a repo was skipped and stores the reason in the state
+// file of c. kind is a short, fixed name for the reason to count skips by.
+func (c *campaign) recordSkip(name, kind, reason string) {
+	repoLog(name).Infof("Skipping %s: %s", name, reason)
+	noteSkip(name, kind, reason)
+	if err := c.state.recordSkip(name, reason); err != nil {
+		logrus.Warnf("saving state for %s failed: %v", name, err)
+	}
+}
+
+// noteSkip counts a skipped repo and writes it to the audit log.
+func noteSkip(name, kind, reason string) {
+	reposSkipped.inc(kind)
+	audit.record(auditEvent{Event: eventSkipped, Repo: name, Reason: kind, Detail: reason})
+}
+
+// recordFailure logs the final failure for a repo and stores the reason in
+// the state file of c.
+func (c *campaign) recordFailure(name, stage string, attempts int, err error) {
+	audit.record(auditEvent{Event: eventFailed, Repo: name, Stage: stage, Error: err.Error()})
+	repoLog(name).Errorf("%s failed at %s after %d attempt(s): %v", name, stage, attempts, err)
+	if serr := c.state.recordFailure(name, stage, attempts, err); serr != nil {
+		logrus.Warnf("saving state for %s failed: %v", name, serr)
+	}
+}
+
+// getFileContent reads path from repo at ref. An empty ref reads the default
+// branch.
+func getFileContent(ctx context.Context, f forge, repo *forgeRepo, path, ref string) (*forgeFile, error) {
+	file, _, err := fetchFile(ctx, f, repo, path, ref)
+	return file, err
+}
+
+// fetchFile is getFileContent that also returns the attempts made, for the
+// pipeline to record with a failure.
+func fetchFile(ctx context.Context, f forge, repo *forgeRepo, path, ref string) (*forgeFile, int, error) {
+	var file *forgeFile
+	attempts, err := retry(ctx, stageContent, func() error {
+		var err error
+		file, err = f.ReadFile(ctx, repo, path, ref)
+		return err
+	})
 	if err != nil {
 		logrus.Debugf("unable to get file content: %v", err)
-		return "", file, repo, err
+		return nil, attempts, err
 	}
-	return fileContent, file, repo, nil
+	return file, attempts, nil
 }
 
-func createCommit(ctx context.Context, client *github.Client, repo *github.Repository, file *github.RepositoryContent, fileContent string) error {
-	// check for an existing commit
-	commits, _, err := client.Repositories.ListCommits(ctx, repo.GetOwner().GetLogin(), repo.GetName(), &github.CommitsListOptions{Author: "golint-fixer"})
-	if err != nil {
+// fixCommitDepth is how many commits of the fix branch are searched for an
+// earlier commit of the fix.
+const fixCommitDepth = 20
+
+// hasFixCommit reports whether the fix branch of t already carries a commit
+// of its rule on top of the upstream default branch, and the attempts made
+// at finding out.
+func hasFixCommit(ctx context.Context, f forge, t *fixTarget) (bool, int, error) {
+	var base, commits []*forgeCommit
+	attempts, err := retry(ctx, stageCommit, func() error {
+		var err error
+		base, err = f.Commits(ctx, t.upstream, t.upstream.DefaultBranch, 1)
 		return err
+	})
+	if err != nil {
+		return false, attempts, err
 	}
-	if len(commits) > 1 {
-		return fmt.Errorf("Duplicate commit in %s", repo.GetName())
+	attempts, err = retry(ctx, stageCommit, func() error {
+		var err error
+		commits, err = f.Commits(ctx, t.head, t.branch, fixCommitDepth)
+		return err
+	})
+	if err != nil {
+		return false, attempts, err
 	}
 
-	if len(commits) == 1 {
-		return nil
+	for _, c := range commits {
+		if len(base) > 0 && c.SHA == base[0].SHA {
+			// everything below is upstream history
+			break
+		}
+		if t.rule.madeBy(c) {
+			return true, attempts, nil
+		}
 	}
+	return false, attempts, nil
+}
 
-	// create commit
-	commitMessage := new(string)
-	*commitMessage = "Fix golint import path"
-	SHA := file.GetSHA()
-	opts := github.RepositoryContentFileOptions{Content: []byte(fileContent), Message: commitMessage, SHA: &SHA}
-	err = updateFile(ctx, client, repo, opts)
+func createCommit(ctx context.Context, f forge, t *fixTarget, file *forgeFile, fileContent, commitMessage string) (int, error) {
+	// check for an existing commit
+	done, attempts, err := hasFixCommit(ctx, f, t)
 	if err != nil {
-		return err
+		return attempts, fmt.Errorf("checking %s in %s for an earlier fix failed: %v", t.branch, t.head.FullName(), err)
+	}
+	if done {
+		logrus.Debugf("%s in %s already has the fix", t.branch, t.head.FullName())
+		return 0, nil
 	}
-	return nil
-}
 
-func updateFile(ctx context.Context, client *github.Client, repo *github.Repository, opts github.RepositoryContentFileOptions) error {
-	_, _, err := client.Repositories.UpdateFile(ctx, repo.GetOwner().GetLogin(), repo.GetName(), ".travis.yml", &opts)
-	if _, ok := err.(*github.RateLimitError); ok {
-		logrus.Fatal("hit rate limit")
+	// create commit
+	var sha string
+	attempts, err = retry(ctx, stageCommit, func() error {
+		var err error
+		sha, err = f.CommitFile(ctx, t.head, t.branch, file, fileContent, &newCommit{
+			Message:   commitMessage,
+			Author:    commitAuthor(),
+			Committer: commitCommitter(),
+		})
 		return err
-	}
+	})
 	if err != nil {
 		logrus.Debug("Failed to create commit")
-		logrus.Error(err)
+		return attempts, err
 	}
-	return nil
+	commitsCreated.inc()
+	audit.record(auditEvent{Event: eventCommitted, Repo: t.upstream.FullName(), SHA: sha})
+	return attempts, nil
 }
 
-func createPullRequest(ctx context.Context, client *github.Client, repo *github.Repository) error {
-	parentRepo := repo.GetParent()
-	title := "Fix golint import path"
-	head := repo.GetOwner().GetLogin() + ":master"
-	base := "master"
-	body := "I am a bot. Please reach out to [@azillion](https://github.com/azillion) if you have any issues, or just close the PR."
-	canEdit := true
-
-	opts := &github.NewPullRequest{}
-	opts.Title = &title
-	opts.Head = &head
-	opts.Base = &base
-	opts.Body = &body
-	opts.MaintainerCanModify = &canEdit
-
-	_, _, err := client.PullRequests.Create(ctx, parentRepo.GetOwner().GetLogin(), parentRepo.GetName(), opts)
-	if _, ok := err.(*github.RateLimitError); ok {
-		logrus.Fatal("hit rate limit")
-		return err
+func createPullRequest(ctx context.Context, f forge, t *fixTarget, msg *prMessage) (*forgePR, int, error) {
+	base := t.upstream.DefaultBranch
+	if base == "" {
+		base = "master"
+	}
+	opts := &newPullRequest{
+		Title: msg.Title,
+		Head:  t.branch,
+		Base:  base,
+		Body:  msg.prBody(),
 	}
+
+	var pr *forgePR
+	attempts, err := retry(ctx, stagePullRequest, func() error {
+		var err error
+		pr, err = f.OpenPR(ctx, t.upstream, t.head, opts)
+		return err
+	})
 	if err != nil {
 		logrus.Debug("Failed to create PR")
-		return err
+		return nil, attempts, err
 	}
-	logrus.Infof("Created PR for %s", repo.GetName())
-	return nil
+	pullRequests.inc("opened")
+	audit.record(auditEvent{Event: eventPROpened, Repo: t.upstream.FullName(), URL: pr.URL})
+	repoLog(t.upstream.FullName()).Infof("Created PR for %s: %s", t.upstream.Name, pr.URL)
+	return pr, attempts, nil
 }
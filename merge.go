@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// mergePollInterval is how often a PR waiting to be merged is checked.
+	mergePollInterval = time.Minute
+	// mergeTimeout is how long we wait for a PR to become mergeable.
+	mergeTimeout = 24 * time.Hour
+)
+
+// autoMerge merges pr once the checks on its head pass and it is
+// mergeable. As soon as checks are reported it asks the forge to merge pr by
+// itself; where the forge can't do that, it merges pr itself. A PR nothing
+// reports checks on is never merged, since there is no telling it is green.
+func autoMerge(ctx context.Context, f forge, c *campaign, upstream *forgeRepo, pr *forgePR, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	// Auto-merge waits for checks to be reported first: Gitea and GitLab
+	// merge on the spot when there are none.
+	tryAutoMerge := true
+	deadline := time.Now().Add(mergeTimeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(mergePollInterval):
+		}
+
+		current, err := f.GetPR(ctx, upstream, pr.Number)
+		if err != nil {
+			logrus.Warnf("checking %s failed: %v", pr.URL, err)
+			continue
+		}
+		if !notePRState(c.state, upstream.FullName(), current) {
+			// merged or closed by someone else
+			return
+		}
+		if !current.Mergeable {
+			continue
+		}
+
+		checks, err := f.CommitChecks(ctx, upstream, current.HeadSHA)
+		if err != nil {
+			logrus.Warnf("getting checks of %s failed: %v", pr.URL, err)
+			continue
+		}
+		if len(checks) == 0 {
+			// Checks may not have been reported yet.
+			continue
+		}
+		if tryAutoMerge {
+			tryAutoMerge = false
+			err := f.EnableAutoMerge(ctx, upstream, current)
+			if err == nil {
+				logrus.Infof("Enabled auto-merge on %s", pr.URL)
+				return
+			}
+			logrus.Debugf("auto-merge on %s not available, merging once checks pass: %v", pr.URL, err)
+		}
+		if combineChecks(checks) != checkSuccess {
+			// Failed checks may still be rerun, so keep waiting.
+			continue
+		}
+
+		attempts, err := retry(ctx, stageMerge, func() error {
+			return f.MergePR(ctx, upstream, current)
+		})
+		if err != nil {
+			c.recordFailure(upstream.FullName(), stageMerge, attempts, err)
+			return
+		}
+		if err := c.state.recordStage(upstream.FullName(), stageMerge); err != nil {
+			logrus.Warnf("saving state for %s failed: %v", upstream.FullName(), err)
+		}
+		notePRState(c.state, upstream.FullName(), &forgePR{State: "closed", Merged: true})
+		audit.record(auditEvent{Event: eventMerged, Repo: upstream.FullName(), SHA: current.HeadSHA, URL: pr.URL})
+		logrus.Infof("Merged %s", pr.URL)
+		return
+	}
+	logrus.Warnf("gave up waiting to merge %s after %s", pr.URL, mergeTimeout)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The metrics are kept in a small registry of our own and served in the
+// Prometheus text format, which is all a scraper needs.
+var (
+	searchPages = newCounterVec("golint_fixer_search_pages_total",
+		"Search result pages fetched.")
+	reposDiscovered = newCounterVec("golint_fixer_repos_discovered_total",
+		"Repositories found by the repository source.", "source")
+	reposSkipped = newCounterVec("golint_fixer_repos_skipped_total",
+		"Repositories left alone, by reason.", "reason")
+	forksCreated = newCounterVec("golint_fixer_forks_total",
+		"Forks created or reused to commit a fix to.")
+	commitsCreated = newCounterVec("golint_fixer_commits_total",
+		"Fix commits made.")
+	pullRequests = newCounterVec("golint_fixer_pull_requests_total",
+		"Pull requests opened, merged or closed.", "event")
+	apiCalls = newCounterVec("golint_fixer_api_calls_total",
+		"Forge API calls by endpoint and response status.", "method", "endpoint", "status")
+	rateLimitWaits = newCounterVec("golint_fixer_rate_limit_waits_total",
+		"Times a stage waited for a rate limit to reset.", "stage")
+	rateLimitWaitSeconds = newCounterVec("golint_fixer_rate_limit_wait_seconds_total",
+		"Time spent waiting for rate limits to reset.", "stage")
+	stageDuration = newHistogramVec("golint_fixer_stage_duration_seconds",
+		"Time a pipeline stage took, retries included.",
+		[]float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "stage", "result")
+)
+
+// metric is a family of series that can write itself out.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	registry  []metric
+)
+
+func register(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	registry = append(registry, m)
+}
+
+// counterVec is a counter with a value per combination of labels.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{name: name, help: help, labels: labels, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+func (c *counterVec) inc(values ...string) {
+	c.add(1, values...)
+}
+
+func (c *counterVec) add(v float64, values ...string) {
+	key := labelKey(c.labels, values)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %g\n", c.name, key, c.values[key])
+	}
+}
+
+// histogramVec is a histogram with a set of buckets per combination of
+// labels.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: map[string]*histogram{}}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) observe(v float64, values ...string) {
+	key := labelKey(h.labels, values)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+// since observes the seconds passed since start.
+func (h *histogramVec) since(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", fmt.Sprintf("%g", le)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, withLabel(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", h.name, key, s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, s.count)
+	}
+}
+
+// labelKey formats label values as they appear in the exposition format,
+// like {stage="fork"}.
+func labelKey(names, values []string) string {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("metric has labels %v, got values %v", names, values))
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", names[i], values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withLabel adds one more label to a formatted label key.
+func withLabel(key, name, value string) string {
+	pair := fmt.Sprintf("%s=%q", name, value)
+	if key == "" {
+		return "{" + pair + "}"
+	}
+	return strings.TrimSuffix(key, "}") + "," + pair + "}"
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeMetrics writes every registered metric in the Prometheus text
+// format.
+func writeMetrics(w io.Writer) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	for _, m := range registry {
+		m.write(w)
+	}
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// serveMetrics serves /metrics on addr until the process exits.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	logrus.Infof("Serving metrics on %s/metrics", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("metrics server failed: %v", err)
+	}
+}
+
+// instrumentedTransport counts the API calls made through it and keeps
+// track of the rate limits they report.
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = fmt.Sprintf("%d", resp.StatusCode)
+		rateLimits.observe(resp.Header)
+	}
+	apiCalls.inc(req.Method, apiEndpoint(req.URL.Path), status)
+	return resp, err
+}
+
+// apiEndpoint reduces an API path to a route with owners, names and IDs
+// left out, so the endpoint label stays small: /repos/a/b/contents/x
+// becomes /repos/:owner/:repo/contents.
+func apiEndpoint(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	// drop the /api/v3, /api/v1 or /api/v4 prefix
+	if len(segments) >= 2 && segments[0] == "api" && strings.HasPrefix(segments[1], "v") {
+		segments = segments[2:]
+	}
+	if len(segments) == 0 || segments[0] == "" {
+		return "/"
+	}
+
+	switch segments[0] {
+	case "repos":
+		if len(segments) > 3 {
+			return "/repos/:owner/:repo/" + segments[3]
+		}
+		return "/repos/:owner/:repo"
+	case "projects":
+		if len(segments) > 2 {
+			return "/projects/:id/" + segments[2]
+		}
+		return "/projects/:id"
+	case "users", "orgs", "groups":
+		if len(segments) > 2 {
+			return "/" + segments[0] + "/:name/" + segments[2]
+		}
+		if len(segments) > 1 {
+			return "/" + segments[0] + "/:name"
+		}
+	case "search":
+		if len(segments) > 1 {
+			return "/search/" + segments[1]
+		}
+	}
+	return "/" + segments[0]
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const planHelp = `Plan the changes the bot would make, to approve them before they are made.
+
+Runs discovery and the rules like the bot does, without forking, committing
+or writing to the state file, and writes a plan file listing every
+repository that would get a PR: the files changed, their diffs and the blob
+SHAs the diffs were made against. Every item starts out pending.
+
+Approve or reject items with -interactive, or by setting their "status" to
+"approved" or "rejected" in the plan file, then run apply with it.`
+
+func (cmd *planCommand) Name() string      { return "plan" }
+func (cmd *planCommand) Args() string      { return "[-o <file>] [-limit <n>] [-interactive]" }
+func (cmd *planCommand) ShortHelp() string { return "Plan changes for approval before applying." }
+func (cmd *planCommand) LongHelp() string  { return planHelp }
+func (cmd *planCommand) Hidden() bool      { return false }
+
+func (cmd *planCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.out, "o", "plan.json", "write the plan to this file")
+	fs.IntVar(&cmd.limit, "limit", 0, "stop after looking at this many repos, 0 for no limit")
+	fs.BoolVar(&cmd.interactive, "interactive", false, "ask whether to approve each change before writing the plan")
+}
+
+type planCommand struct {
+	out         string
+	limit       int
+	interactive bool
+}
+
+const applyHelp = `Make the changes approved in a plan file.
+
+Only items whose status is "approved" are applied. An item is refused if
+any of its files has changed upstream since the plan was made, or if its
+rule has changed since, so nothing is pushed that was not reviewed.`
+
+func (cmd *applyCommand) Name() string      { return "apply" }
+func (cmd *applyCommand) Args() string      { return "<plan file>" }
+func (cmd *applyCommand) ShortHelp() string { return "Apply the approved changes of a plan." }
+func (cmd *applyCommand) LongHelp() string  { return applyHelp }
+func (cmd *applyCommand) Hidden() bool      { return false }
+
+func (cmd *applyCommand) Register(fs *flag.FlagSet) {}
+
+type applyCommand struct{}
+
+// The statuses of a plan item.
+const (
+	planPending  = "pending"
+	planApproved = "approved"
+	planRejected = "rejected"
+)
+
+// plan is the changes the bot would make for a campaign, each waiting to be
+// approved or rejected.
+type plan struct {
+	Campaign  string      `json:"campaign,omitempty"`
+	Source    string      `json:"source"`
+	CreatedAt time.Time   `json:"created_at"`
+	Items     []*planItem `json:"items"`
+}
+
+// planItem is the change to a single repository.
+type planItem struct {
+	Repo string `json:"repo"`
+	URL  string `json:"url"`
+	// Rule is the rule and its version, as in golint-import@v1.
+	Rule   string      `json:"rule"`
+	Status string      `json:"status"`
+	Files  []*planFile `json:"files"`
+}
+
+// planFile is a file a plan item changes. BlobSHA is the blob the diff was
+// made against.
+type planFile struct {
+	Path    string `json:"path"`
+	BlobSHA string `json:"blob_sha"`
+	Diff    string `json:"diff"`
+}
+
+func (cmd *planCommand) Run(ctx context.Context, args []string) error {
+	c, err := currentCampaign()
+	if err != nil {
+		return err
+	}
+	f, err := connectForge(ctx)
+	if err != nil {
+		return err
+	}
+
+	p, err := makePlan(ctx, f, c, cmd.limit)
+	if err != nil {
+		return err
+	}
+	if cmd.interactive {
+		reviewPlan(p, os.Stdin, os.Stdout)
+	}
+	if err := writePlan(cmd.out, p); err != nil {
+		return err
+	}
+
+	counts := p.counts()
+	fmt.Printf("Planned %d change(s), %d approved, %d rejected, %d pending. Wrote %s.\n",
+		len(p.Items), counts[planApproved], counts[planRejected], counts[planPending], cmd.out)
+	return nil
+}
+
+func (cmd *applyCommand) Run(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("pass the plan file to apply")
+	}
+	p, err := readPlan(args[0])
+	if err != nil {
+		return err
+	}
+	c := findCampaign(p.Campaign)
+	if c == nil {
+		return fmt.Errorf("the plan is for campaign %q, which is not configured", p.Campaign)
+	}
+
+	var approved []*planItem
+	for _, item := range p.Items {
+		if item.Status == planApproved {
+			approved = append(approved, item)
+		}
+	}
+	if len(approved) == 0 {
+		logrus.Info("Nothing approved to apply.")
+		return nil
+	}
+
+	f, err := connectForge(ctx)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Applying %d approved change(s).", len(approved))
+	var refused int
+	runPipeline(ctx, f, c, func(targets chan<- *fixTarget, wg *sync.WaitGroup) {
+		defer close(targets)
+		defer wg.Done()
+
+		for _, item := range approved {
+			t, reason, err := planTarget(ctx, f, c, item)
+			switch {
+			case err != nil:
+				stage, attempts, err := errorStage(err, stageUpstreamCheck)
+				c.recordFailure(item.Repo, stage, attempts, err)
+				refused++
+			case t == nil:
+				c.recordSkip(item.Repo, "plan-stale", reason)
+				refused++
+			default:
+				targets <- t
+			}
+		}
+	})
+	logrus.Infof("Sent %d change(s) down the pipeline, refused %d.", len(approved)-refused, refused)
+	return nil
+}
+
+// makePlan runs discovery and the rules of c, looking at up to limit repos,
+// and plans a change for every repo the bot would open a PR against.
+func makePlan(ctx context.Context, f forge, c *campaign, limit int) (*plan, error) {
+	p := &plan{Campaign: c.Name, Source: c.src.Name(), CreatedAt: time.Now().UTC()}
+	seen := map[string]bool{}
+
+	logrus.Infof("Planning changes to repositories from %s", c.src.Name())
+	err := c.src.Repos(ctx, f, func(repo *forgeRepo) bool {
+		name := repo.FullName()
+		if seen[name] {
+			return true
+		}
+		seen[name] = true
+		if len(seen)%100 == 0 {
+			logrus.Infof("Looked at %d repositories, planned %d changes", len(seen), len(p.Items))
+		}
+
+		if item := planRepo(ctx, f, c, repo); item != nil {
+			p.Items = append(p.Items, item)
+		}
+		return (limit <= 0 || len(seen) < limit) && ctx.Err() == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// planRepo returns the change the bot would make to repo, or nil if it
+// would leave it alone. It only logs why, leaving the state file, metrics
+// and audit log alone.
+func planRepo(ctx context.Context, f forge, c *campaign, repo *forgeRepo) *planItem {
+	r, kind, reason, err := checkEligible(ctx, f, c, repo)
+	if err != nil {
+		logrus.Warnf("checking %s failed: %v", repo.FullName(), err)
+		return nil
+	}
+	if r == nil {
+		logrus.Debugf("not planning %s, %s: %s", repo.FullName(), kind, reason)
+		return nil
+	}
+
+	// Search results are partial, the policy needs the full repo.
+	full, err := getRepo(ctx, f, repo.FullName())
+	if err != nil {
+		logrus.Warnf("getting %s failed: %v", repo.FullName(), err)
+		return nil
+	}
+	if kind, reason := c.policy.allowsRepo(full); kind != "" {
+		logrus.Debugf("not planning %s, %s: %s", full.FullName(), kind, reason)
+		return nil
+	}
+
+	file, err := getFileContent(ctx, f, full, r.Path, full.DefaultBranch)
+	if err != nil {
+		logrus.Warnf("reading %s from %s failed: %v", r.Path, full.FullName(), err)
+		return nil
+	}
+	fixed, changed := r.apply(file.Content)
+	if !changed {
+		return nil
+	}
+	return &planItem{
+		Repo:   full.FullName(),
+		URL:    full.HTMLURL,
+		Rule:   r.ref(),
+		Status: planPending,
+		Files:  []*planFile{{Path: file.Path, BlobSHA: file.SHA, Diff: unifiedDiff(file.Path, file.Content, fixed)}},
+	}
+}
+
+// planTarget checks that nothing item was planned against has changed and
+// returns the target to send down the pipeline. It returns a nil target and
+// the reason if item has to be refused. Errors record the attempts made.
+func planTarget(ctx context.Context, f forge, c *campaign, item *planItem) (*fixTarget, string, error) {
+	var r *rule
+	for _, cand := range c.rules {
+		if cand.ref() == item.Rule {
+			r = cand
+			break
+		}
+	}
+	if r == nil {
+		return nil, fmt.Sprintf("rule %s has changed since the plan was made", item.Rule), nil
+	}
+
+	repo, attempts, err := fetchRepo(ctx, f, item.Repo)
+	if err != nil {
+		return nil, "", &stageError{stageUpstreamCheck, attempts, err}
+	}
+	planned := map[string]string{}
+	for _, pf := range item.Files {
+		file, attempts, err := fetchFile(ctx, f, repo, pf.Path, repo.DefaultBranch)
+		if err != nil {
+			return nil, "", &stageError{stageContent, attempts, err}
+		}
+		if file.SHA != pf.BlobSHA {
+			return nil, fmt.Sprintf("%s changed upstream since the plan was made", pf.Path), nil
+		}
+		planned[pf.Path] = pf.BlobSHA
+	}
+
+	opened, attempts, err := hasBotPullRequest(ctx, f, c, repo)
+	if err != nil {
+		return nil, "", &stageError{stageDuplicate, attempts, err}
+	}
+	if opened {
+		return nil, "bot already opened a PR", nil
+	}
+	return &fixTarget{upstream: repo, rule: r, planned: planned}, "", nil
+}
+
+// reviewPlan shows every pending item of p with its diff and asks whether
+// to approve it.
+func reviewPlan(p *plan, in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+	for i, item := range p.Items {
+		if item.Status != planPending {
+			continue
+		}
+		fmt.Fprintf(out, "\n[%d/%d] %s (%s)\n%s\n", i+1, len(p.Items), item.Repo, item.Rule, item.URL)
+		for _, pf := range item.Files {
+			fmt.Fprintf(out, "\n%s", pf.Diff)
+		}
+
+		for answered := false; !answered; {
+			fmt.Fprint(out, "\nApprove this change? [y]es, [n]o, [s]kip, [q]uit: ")
+			if !scanner.Scan() {
+				return
+			}
+			answered = true
+			switch strings.ToLower(strings.TrimSpace(scanner.Text())) {
+			case "y", "yes":
+				item.Status = planApproved
+			case "n", "no":
+				item.Status = planRejected
+			case "s", "skip", "":
+			case "q", "quit":
+				return
+			default:
+				answered = false
+			}
+		}
+	}
+}
+
+// counts returns the number of items of p by status.
+func (p *plan) counts() map[string]int {
+	counts := map[string]int{}
+	for _, item := range p.Items {
+		counts[item.Status]++
+	}
+	return counts
+}
+
+func writePlan(path string, p *plan) error {
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+func readPlan(path string) (*plan, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var p plan
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("parsing plan %s failed: %v", path, err)
+	}
+	for _, item := range p.Items {
+		switch item.Status {
+		case planPending, planApproved, planRejected:
+		default:
+			return nil, fmt.Errorf("%s: unknown status %q, must be pending, approved or rejected", item.Repo, item.Status)
+		}
+	}
+	return &p, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+)
+
+const renderHelp = `Preview the PR title, body and commit message of a rule.
+
+With a repository the rule is run against its default branch, following the
+repository's PR template and commit style. Without one it is run against a
+made up repository.`
+
+func (cmd *renderCommand) Name() string      { return "render" }
+func (cmd *renderCommand) Args() string      { return "[-rule <name>] [owner/repo]" }
+func (cmd *renderCommand) ShortHelp() string { return "Preview the PR and commit text of a rule." }
+func (cmd *renderCommand) LongHelp() string  { return renderHelp }
+func (cmd *renderCommand) Hidden() bool      { return false }
+
+func (cmd *renderCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.rule, "rule", golintImportRule.Name, "rule to render")
+}
+
+type renderCommand struct {
+	rule string
+}
+
+func (cmd *renderCommand) Run(ctx context.Context, args []string) error {
+	r := findRule(cmd.rule)
+	if r == nil {
+		return fmt.Errorf("unknown rule %q", cmd.rule)
+	}
+
+	var (
+		f      forge
+		repo   *forgeRepo
+		change fileChange
+	)
+	switch len(args) {
+	case 0:
+		repo = &forgeRepo{Owner: "octocat", Name: "hello-world", DefaultBranch: "master", HTMLURL: "https://github.com/octocat/hello-world"}
+		change = newFileChange(r.Path, r.Old, r.New)
+	case 1:
+		var err error
+		f, err = connectForge(ctx)
+		if err != nil {
+			return err
+		}
+		repo, err = getRepo(ctx, f, args[0])
+		if err != nil {
+			return err
+		}
+		file, err := getFileContent(ctx, f, repo, r.Path, "")
+		if err != nil {
+			return err
+		}
+		fixed, changed := r.apply(file.Content)
+		if !changed {
+			return fmt.Errorf("%s in %s needs no changes", r.Path, repo.FullName())
+		}
+		change = newFileChange(file.Path, file.Content, fixed)
+	default:
+		return fmt.Errorf("pass at most one repository")
+	}
+
+	msg, err := r.render(repo, []fileChange{change})
+	if err != nil {
+		return err
+	}
+	if f != nil {
+		followConventions(ctx, f, repo, r, msg)
+		signOff(ctx, f, repo, msg)
+	}
+	fmt.Printf("Title: %s\n\nCommit:\n%s\n\nBody:\n%s\n", msg.Title, msg.Commit, msg.prBody())
+	return nil
+}
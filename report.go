@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/blang/semver"
+	"github.com/sirupsen/logrus"
+)
+
+const reportHelp = `Report on what became of the PRs the bot opened.
+
+Per campaign it gives the PRs opened, merged and closed without merging, the
+merge and close rates (of all PRs opened), the median time to merge and the
+most common reasons maintainers gave for closing. The same numbers are
+broken down by the stars and the oldest Go version of the repositories.
+
+Open PRs and close reasons are looked up on the forge first, unless
+-refresh=false is given.`
+
+func (cmd *reportCommand) Name() string      { return "report" }
+func (cmd *reportCommand) Args() string      { return "[-format <format>] [-o <file>]" }
+func (cmd *reportCommand) ShortHelp() string { return "Report merge rates and close reasons." }
+func (cmd *reportCommand) LongHelp() string  { return reportHelp }
+func (cmd *reportCommand) Hidden() bool      { return false }
+
+func (cmd *reportCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.format, "format", "markdown", "report format: markdown, html, csv or json")
+	fs.StringVar(&cmd.out, "o", "", "write the report to this file instead of stdout")
+	fs.BoolVar(&cmd.refresh, "refresh", true, "look up open PRs and close reasons on the forge first")
+}
+
+type reportCommand struct {
+	format  string
+	out     string
+	refresh bool
+}
+
+func (cmd *reportCommand) Run(ctx context.Context, args []string) error {
+	write, ok := reportWriters[cmd.format]
+	if !ok {
+		return fmt.Errorf("unknown report format %q, must be markdown, html, csv or json", cmd.format)
+	}
+
+	if cmd.refresh {
+		f, err := connectForge(ctx)
+		if err != nil {
+			return err
+		}
+		for _, c := range campaigns {
+			refreshPRs(ctx, f, c)
+		}
+	}
+
+	var opened []repoState
+	for _, c := range campaigns {
+		opened = append(opened, c.state.openedPRs()...)
+	}
+
+	out := io.Writer(os.Stdout)
+	if cmd.out != "" {
+		file, err := os.Create(cmd.out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	return write(out, buildReport(opened))
+}
+
+// openedPRs returns a copy of every repo the bot opened a PR against.
+func (s *stateStore) openedPRs() []repoState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var repos []repoState
+	for _, r := range s.Repos {
+		if r.PR == nil {
+			continue
+		}
+		c := *r
+		pr := *r.PR
+		c.PR = &pr
+		repos = append(repos, c)
+	}
+	sort.Slice(repos, func(i, j int) bool { return repos[i].Repo < repos[j].Repo })
+	return repos
+}
+
+// refreshPRs brings the PRs in the state file of c up to date with the
+// forge: whether they were merged or closed and when, why they were closed,
+// and the repo info older PRs were recorded without.
+func refreshPRs(ctx context.Context, f forge, c *campaign) {
+	st := c.state
+	for _, rs := range st.openedPRs() {
+		pr := rs.PR
+		needPR := pr.State == "open" || pr.OpenedAt.IsZero() || (pr.State != "open" && pr.ClosedAt.IsZero())
+		needReason := pr.State == "closed" && pr.CloseReason == ""
+		if !needPR && !needReason && rs.Info != nil {
+			continue
+		}
+
+		repo, err := getRepo(ctx, f, rs.Repo)
+		if err != nil {
+			logrus.Warnf("refreshing %s failed: %v", rs.Repo, err)
+			continue
+		}
+		if rs.Info == nil {
+			info := &repoInfo{Stars: repo.Stars}
+			if file, err := getFileContent(ctx, f, repo, ".travis.yml", ""); err == nil {
+				info.GoVersions = travisGoVersions(file.Content)
+			}
+			if err := st.recordRepoInfo(rs.Repo, info); err != nil {
+				logrus.Warnf("saving repo info for %s failed: %v", rs.Repo, err)
+			}
+		}
+
+		if needPR {
+			current, err := f.GetPR(ctx, repo, pr.Number)
+			if err != nil {
+				logrus.Warnf("getting %s failed: %v", pr.URL, err)
+				continue
+			}
+			if err := st.recordPROutcome(rs.Repo, current); err != nil {
+				logrus.Warnf("saving PR state for %s failed: %v", rs.Repo, err)
+			}
+			needReason = prOutcome(current) == "closed" && pr.CloseReason == ""
+		}
+
+		if needReason {
+			comments, err := f.Comments(ctx, repo, pr.Number)
+			if err != nil {
+				logrus.Warnf("getting comments of %s failed: %v", pr.URL, err)
+				continue
+			}
+			reason, comment := closeReason(comments)
+			if err := st.recordCloseReason(rs.Repo, reason, comment); err != nil {
+				logrus.Warnf("saving close reason for %s failed: %v", rs.Repo, err)
+			}
+		}
+	}
+}
+
+// closeReasons sort what maintainers say when closing a PR into a few
+// reasons. The first match wins.
+var closeReasons = []struct {
+	reason string
+	re     *regexp.Regexp
+}{
+	{"already fixed", regexp.MustCompile(`(?i)already (been )?(fixed|done|merged|addressed|updated)|duplicate|fixed (in|by)|supersede`)},
+	{"unmaintained", regexp.MustCompile(`(?i)archiv|deprecat|unmaintained|(no longer|not) (actively )?maintained|abandon`)},
+	{"not using travis", regexp.MustCompile(`(?i)travis|github actions|circleci|(moved|migrated|switched) (to|away)`)},
+	{"unwanted bot PR", regexp.MustCompile(`(?i)\bbots?\b|spam|automated|unsolicited`)},
+	{"CLA", regexp.MustCompile(`(?i)\bcla\b|contributor license`)},
+}
+
+// maxCloseComment is how much of a close comment is kept.
+const maxCloseComment = 280
+
+// closeReason picks the last comment not made by the bot and sorts it into
+// one of the closeReasons.
+func closeReason(comments []*forgeComment) (string, string) {
+	for i := len(comments) - 1; i >= 0; i-- {
+		c := comments[i]
+		if strings.EqualFold(c.Author, botLogin) {
+			continue
+		}
+		comment := strings.TrimSpace(c.Body)
+		if r := []rune(comment); len(r) > maxCloseComment {
+			comment = string(r[:maxCloseComment]) + "…"
+		}
+		for _, cr := range closeReasons {
+			if cr.re.MatchString(c.Body) {
+				return cr.reason, comment
+			}
+		}
+		return "other", comment
+	}
+	return "no comment", ""
+}
+
+// outcomeStats sums up what became of a set of PRs.
+type outcomeStats struct {
+	Opened int `json:"opened"`
+	Open   int `json:"open"`
+	Merged int `json:"merged"`
+	// Closed counts the PRs closed without merging.
+	Closed             int     `json:"closed"`
+	MergeRate          float64 `json:"merge_rate"`
+	CloseRate          float64 `json:"close_rate"`
+	MedianHoursToMerge float64 `json:"median_hours_to_merge,omitempty"`
+
+	toMerge []time.Duration
+}
+
+func (s *outcomeStats) add(pr *prState) {
+	s.Opened++
+	switch pr.State {
+	case "merged":
+		s.Merged++
+		if !pr.OpenedAt.IsZero() && pr.ClosedAt.After(pr.OpenedAt) {
+			s.toMerge = append(s.toMerge, pr.ClosedAt.Sub(pr.OpenedAt))
+		}
+	case "closed":
+		s.Closed++
+	default:
+		s.Open++
+	}
+}
+
+// finish works out the rates and the median once all PRs are added.
+func (s *outcomeStats) finish() {
+	if s.Opened > 0 {
+		s.MergeRate = float64(s.Merged) / float64(s.Opened)
+		s.CloseRate = float64(s.Closed) / float64(s.Opened)
+	}
+	if n := len(s.toMerge); n > 0 {
+		sort.Slice(s.toMerge, func(i, j int) bool { return s.toMerge[i] < s.toMerge[j] })
+		median := s.toMerge[n/2]
+		if n%2 == 0 {
+			median = (s.toMerge[n/2-1] + s.toMerge[n/2]) / 2
+		}
+		s.MedianHoursToMerge = median.Hours()
+	}
+}
+
+// bucketStats are the outcomes of the PRs against repos in one bucket,
+// like the ones with 100 to 999 stars.
+type bucketStats struct {
+	Bucket string `json:"bucket"`
+	outcomeStats
+}
+
+type reasonCount struct {
+	Reason string `json:"reason"`
+	Count  int    `json:"count"`
+}
+
+type campaignReport struct {
+	Campaign     string         `json:"campaign"`
+	Total        outcomeStats   `json:"total"`
+	ByStars      []*bucketStats `json:"by_stars"`
+	ByGoVersion  []*bucketStats `json:"by_go_version"`
+	CloseReasons []reasonCount  `json:"close_reasons"`
+}
+
+type report struct {
+	GeneratedAt time.Time         `json:"generated_at"`
+	Campaigns   []*campaignReport `json:"campaigns"`
+}
+
+// starBuckets are the star ranges, in the order they are reported.
+var starBuckets = []struct {
+	name string
+	min  int
+}{
+	{"1000+", 1000},
+	{"100-999", 100},
+	{"10-99", 10},
+	{"0-9", 0},
+}
+
+func starBucket(info *repoInfo) string {
+	if info == nil {
+		return "unknown"
+	}
+	for _, b := range starBuckets {
+		if info.Stars >= b.min {
+			return b.name
+		}
+	}
+	return "unknown"
+}
+
+// goVersionBucket returns the oldest Go version a repo builds with as
+// major.minor.
+func goVersionBucket(info *repoInfo) string {
+	if info == nil {
+		return "unknown"
+	}
+	if len(info.GoVersions) == 0 {
+		return "none listed"
+	}
+	var oldest *semver.Version
+	for _, v := range info.GoVersions {
+		ver, err := semver.ParseTolerant(v)
+		if err != nil {
+			continue
+		}
+		if oldest == nil || ver.LT(*oldest) {
+			oldest = &ver
+		}
+	}
+	if oldest == nil {
+		return "unparsed"
+	}
+	return fmt.Sprintf("%d.%d", oldest.Major, oldest.Minor)
+}
+
+// buildReport sums up repos per campaign.
+func buildReport(repos []repoState) *report {
+	type buckets map[string]*bucketStats
+	var (
+		campaigns = map[string]*campaignReport{}
+		stars     = map[string]buckets{}
+		versions  = map[string]buckets{}
+		reasons   = map[string]map[string]int{}
+	)
+	bucket := func(all map[string]buckets, campaign, name string) *bucketStats {
+		if all[campaign] == nil {
+			all[campaign] = buckets{}
+		}
+		b, ok := all[campaign][name]
+		if !ok {
+			b = &bucketStats{Bucket: name}
+			all[campaign][name] = b
+		}
+		return b
+	}
+
+	for _, rs := range repos {
+		name := rs.PR.Campaign
+		if name == "" {
+			name = "(none)"
+		}
+		c, ok := campaigns[name]
+		if !ok {
+			c = &campaignReport{Campaign: name}
+			campaigns[name] = c
+			reasons[name] = map[string]int{}
+		}
+		c.Total.add(rs.PR)
+		bucket(stars, name, starBucket(rs.Info)).add(rs.PR)
+		bucket(versions, name, goVersionBucket(rs.Info)).add(rs.PR)
+		if rs.PR.State == "closed" {
+			reason := rs.PR.CloseReason
+			if reason == "" {
+				reason = "not looked up"
+			}
+			reasons[name][reason]++
+		}
+	}
+
+	r := &report{GeneratedAt: time.Now().UTC()}
+	for name, c := range campaigns {
+		c.Total.finish()
+		for _, sb := range starBuckets {
+			if b, ok := stars[name][sb.name]; ok {
+				b.finish()
+				c.ByStars = append(c.ByStars, b)
+			}
+		}
+		if b, ok := stars[name]["unknown"]; ok {
+			b.finish()
+			c.ByStars = append(c.ByStars, b)
+		}
+		for _, b := range versions[name] {
+			b.finish()
+			c.ByGoVersion = append(c.ByGoVersion, b)
+		}
+		sort.Slice(c.ByGoVersion, func(i, j int) bool {
+			return versionLess(c.ByGoVersion[i].Bucket, c.ByGoVersion[j].Bucket)
+		})
+		for reason, n := range reasons[name] {
+			c.CloseReasons = append(c.CloseReasons, reasonCount{Reason: reason, Count: n})
+		}
+		sort.Slice(c.CloseReasons, func(i, j int) bool {
+			a, b := c.CloseReasons[i], c.CloseReasons[j]
+			if a.Count != b.Count {
+				return a.Count > b.Count
+			}
+			return a.Reason < b.Reason
+		})
+		r.Campaigns = append(r.Campaigns, c)
+	}
+	sort.Slice(r.Campaigns, func(i, j int) bool { return r.Campaigns[i].Campaign < r.Campaigns[j].Campaign })
+	return r
+}
+
+// versionLess orders Go version buckets oldest first, with the ones that
+// are not versions last.
+func versionLess(a, b string) bool {
+	va, erra := semver.ParseTolerant(a)
+	vb, errb := semver.ParseTolerant(b)
+	switch {
+	case erra == nil && errb == nil:
+		return va.LT(vb)
+	case erra == nil:
+		return true
+	case errb == nil:
+		return false
+	}
+	return a < b
+}
+
+func percent(f float64) string {
+	return fmt.Sprintf("%.1f%%", f*100)
+}
+
+func humanHours(h float64) string {
+	switch {
+	case h == 0:
+		return "-"
+	case h < 48:
+		return fmt.Sprintf("%.1fh", h)
+	}
+	return fmt.Sprintf("%.1fd", h/24)
+}
+
+var reportFuncs = map[string]interface{}{
+	"percent": percent,
+	"hours":   humanHours,
+}
+
+// reportWriters write a report in each of the supported formats.
+var reportWriters = map[string]func(io.Writer, *report) error{
+	"markdown": writeMarkdownReport,
+	"html":     writeHTMLReport,
+	"csv":      writeCSVReport,
+	"json": func(w io.Writer, r *report) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	},
+}
+
+var markdownReport = template.Must(template.New("report").Funcs(reportFuncs).Parse(`# Campaign report
+
+Generated {{.GeneratedAt.Format "2006-01-02 15:04 MST"}}. Rates are of all PRs opened.
+{{range .Campaigns}}
+## {{.Campaign}}
+
+| Opened | Open | Merged | Closed without merge | Merge rate | Close rate | Median time to merge |
+|---:|---:|---:|---:|---:|---:|---:|
+{{with .Total}}| {{.Opened}} | {{.Open}} | {{.Merged}} | {{.Closed}} | {{percent .MergeRate}} | {{percent .CloseRate}} | {{hours .MedianHoursToMerge}} |{{end}}
+
+### By stars
+
+| Stars | Opened | Merged | Closed | Merge rate | Median time to merge |
+|---|---:|---:|---:|---:|---:|
+{{range .ByStars}}| {{.Bucket}} | {{.Opened}} | {{.Merged}} | {{.Closed}} | {{percent .MergeRate}} | {{hours .MedianHoursToMerge}} |
+{{end}}
+### By oldest Go version
+
+| Go | Opened | Merged | Closed | Merge rate | Median time to merge |
+|---|---:|---:|---:|---:|---:|
+{{range .ByGoVersion}}| {{.Bucket}} | {{.Opened}} | {{.Merged}} | {{.Closed}} | {{percent .MergeRate}} | {{hours .MedianHoursToMerge}} |
+{{end}}
+### Close reasons
+{{if .CloseReasons}}
+{{range .CloseReasons}}- {{.Reason}}: {{.Count}}
+{{end}}{{else}}
+No PRs were closed without merging.
+{{end}}{{end}}`))
+
+func writeMarkdownReport(w io.Writer, r *report) error {
+	return markdownReport.Execute(w, r)
+}
+
+var htmlReport = htmltemplate.Must(htmltemplate.New("report").Funcs(reportFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Campaign report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: .3em .6em; }
+td.n { text-align: right; }
+</style>
+</head>
+<body>
+<h1>Campaign report</h1>
+<p>Generated {{.GeneratedAt.Format "2006-01-02 15:04 MST"}}. Rates are of all PRs opened.</p>
+{{range .Campaigns}}
+<h2>{{.Campaign}}</h2>
+<table>
+<tr><th>Opened</th><th>Open</th><th>Merged</th><th>Closed without merge</th><th>Merge rate</th><th>Close rate</th><th>Median time to merge</th></tr>
+{{with .Total}}<tr><td class="n">{{.Opened}}</td><td class="n">{{.Open}}</td><td class="n">{{.Merged}}</td><td class="n">{{.Closed}}</td><td class="n">{{percent .MergeRate}}</td><td class="n">{{percent .CloseRate}}</td><td class="n">{{hours .MedianHoursToMerge}}</td></tr>{{end}}
+</table>
+<h3>By stars</h3>
+<table>
+<tr><th>Stars</th><th>Opened</th><th>Merged</th><th>Closed</th><th>Merge rate</th><th>Median time to merge</th></tr>
+{{range .ByStars}}<tr><td>{{.Bucket}}</td><td class="n">{{.Opened}}</td><td class="n">{{.Merged}}</td><td class="n">{{.Closed}}</td><td class="n">{{percent .MergeRate}}</td><td class="n">{{hours .MedianHoursToMerge}}</td></tr>
+{{end}}</table>
+<h3>By oldest Go version</h3>
+<table>
+<tr><th>Go</th><th>Opened</th><th>Merged</th><th>Closed</th><th>Merge rate</th><th>Median time to merge</th></tr>
+{{range .ByGoVersion}}<tr><td>{{.Bucket}}</td><td class="n">{{.Opened}}</td><td class="n">{{.Merged}}</td><td class="n">{{.Closed}}</td><td class="n">{{percent .MergeRate}}</td><td class="n">{{hours .MedianHoursToMerge}}</td></tr>
+{{end}}</table>
+<h3>Close reasons</h3>
+{{if .CloseReasons}}<ul>
+{{range .CloseReasons}}<li>{{.Reason}}: {{.Count}}</li>
+{{end}}</ul>{{else}}<p>No PRs were closed without merging.</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+func writeHTMLReport(w io.Writer, r *report) error {
+	return htmlReport.Execute(w, r)
+}
+
+// writeCSVReport writes one row per campaign total and per bucket. Close
+// reasons are rows of their own with the count in the closed column.
+func writeCSVReport(w io.Writer, r *report) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"campaign", "dimension", "bucket", "opened", "open", "merged", "closed", "merge_rate", "close_rate", "median_hours_to_merge"})
+	row := func(campaign, dimension, bucket string, s *outcomeStats) {
+		cw.Write([]string{
+			campaign, dimension, bucket,
+			strconv.Itoa(s.Opened), strconv.Itoa(s.Open), strconv.Itoa(s.Merged), strconv.Itoa(s.Closed),
+			strconv.FormatFloat(s.MergeRate, 'f', 4, 64),
+			strconv.FormatFloat(s.CloseRate, 'f', 4, 64),
+			strconv.FormatFloat(s.MedianHoursToMerge, 'f', 1, 64),
+		})
+	}
+	for _, c := range r.Campaigns {
+		row(c.Campaign, "total", "", &c.Total)
+		for _, b := range c.ByStars {
+			row(c.Campaign, "stars", b.Bucket, &b.outcomeStats)
+		}
+		for _, b := range c.ByGoVersion {
+			row(c.Campaign, "go_version", b.Bucket, &b.outcomeStats)
+		}
+		for _, reason := range c.CloseReasons {
+			cw.Write([]string{c.Campaign, "close_reason", reason.Reason, "", "", "", strconv.Itoa(reason.Count), "", "", ""})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+// Pipeline stages, used to pick a retry policy and to record where a repo
+// failed.
+const (
+	stageSearch        = "search"
+	stageContent       = "content"
+	stageDuplicate     = "duplicate-check"
+	stageUpstreamCheck = "upstream-check"
+	stageFork          = "fork"
+	stageForkReady     = "fork-ready"
+	stageSync          = "sync"
+	stageBranch        = "branch"
+	stageCommit        = "commit"
+	stagePullRequest   = "pull-request"
+	stageMerge         = "merge"
+	stageChecks        = "checks"
+
+	// stageSkipped is recorded for repos the pipeline decided to leave
+	// alone.
+	stageSkipped = "skipped"
+)
+
+// errorClass describes how the retry layer should treat an error.
+type errorClass int
+
+const (
+	classPermanent errorClass = iota
+	classRetryable
+	classRateLimited
+)
+
+func (c errorClass) String() string {
+	switch c {
+	case classRetryable:
+		return "retryable"
+	case classRateLimited:
+		return "rate-limited"
+	default:
+		return "permanent"
+	}
+}
+
+// retryableError marks an error that would otherwise be classified as
+// permanent as safe to retry, e.g. a 404 while GitHub is still creating a
+// fork.
+type retryableError struct {
+	error
+}
+
+// retryPolicy caps the attempts for a stage and bounds the backoff between
+// them.
+type retryPolicy struct {
+	attempts int
+	base     time.Duration
+	max      time.Duration
+}
+
+var retryPolicies = map[string]retryPolicy{
+	stageSearch:        {attempts: 5, base: 4 * time.Second, max: time.Minute},
+	stageContent:       {attempts: 3, base: time.Second, max: 15 * time.Second},
+	stageDuplicate:     {attempts: 3, base: time.Second, max: 15 * time.Second},
+	stageUpstreamCheck: {attempts: 3, base: time.Second, max: 15 * time.Second},
+	stageFork:          {attempts: 3, base: 5 * time.Second, max: time.Minute},
+	stageForkReady:     {attempts: 6, base: 10 * time.Second, max: 2 * time.Minute},
+	stageSync:          {attempts: 3, base: 2 * time.Second, max: 30 * time.Second},
+	stageBranch:        {attempts: 3, base: 2 * time.Second, max: 30 * time.Second},
+	stageCommit:        {attempts: 3, base: 2 * time.Second, max: 30 * time.Second},
+	stagePullRequest:   {attempts: 3, base: 2 * time.Second, max: 30 * time.Second},
+	stageMerge:         {attempts: 3, base: 5 * time.Second, max: time.Minute},
+	stageChecks:        {attempts: 3, base: 2 * time.Second, max: 30 * time.Second},
+}
+
+var defaultRetryPolicy = retryPolicy{attempts: 3, base: 2 * time.Second, max: 30 * time.Second}
+
+// backoff returns the jittered delay before the next attempt.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.base << uint(attempt-1)
+	if d <= 0 || d > p.max {
+		d = p.max
+	}
+	// Use "equal jitter" so we never retry immediately but still spread out
+	// goroutines that failed at the same time.
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// classifyError sorts an error into retryable, rate-limited or permanent.
+func classifyError(err error) errorClass {
+	switch e := err.(type) {
+	case nil:
+		return classPermanent
+	case retryableError:
+		return classRetryable
+	case *stageError:
+		return classifyError(e.err)
+	case *httpError:
+		if e.StatusCode == http.StatusTooManyRequests {
+			return classRateLimited
+		}
+		if e.StatusCode >= http.StatusInternalServerError {
+			return classRetryable
+		}
+		return classPermanent
+	case *github.RateLimitError, *github.AbuseRateLimitError:
+		return classRateLimited
+	case *github.AcceptedError:
+		return classRetryable
+	case *github.ErrorResponse:
+		if e.Response != nil && e.Response.StatusCode >= http.StatusInternalServerError {
+			return classRetryable
+		}
+		return classPermanent
+	case *url.Error:
+		return classifyError(e.Err)
+	case *net.OpError:
+		return classRetryable
+	case net.Error:
+		if e.Timeout() {
+			return classRetryable
+		}
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == syscall.ECONNRESET {
+		return classRetryable
+	}
+	if strings.Contains(err.Error(), "connection reset by peer") {
+		return classRetryable
+	}
+	return classPermanent
+}
+
+// rateLimitWait returns how long GitHub asked us to back off for.
+func rateLimitWait(err error) time.Duration {
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		return time.Until(e.Rate.Reset.Time) + time.Second
+	case *github.AbuseRateLimitError:
+		if e.RetryAfter != nil {
+			return *e.RetryAfter
+		}
+		return time.Minute
+	case *httpError:
+		if e.RetryAfter > 0 {
+			return e.RetryAfter
+		}
+		return time.Minute
+	}
+	return 0
+}
+
+// errorStatus returns the HTTP status code carried by err, or 0 if there is
+// none.
+func errorStatus(err error) int {
+	var resp *http.Response
+	switch e := err.(type) {
+	case retryableError:
+		return errorStatus(e.error)
+	case *stageError:
+		return errorStatus(e.err)
+	case *httpError:
+		return e.StatusCode
+	case *github.ErrorResponse:
+		resp = e.Response
+	case *github.RateLimitError:
+		resp = e.Response
+	case *github.AbuseRateLimitError:
+		resp = e.Response
+	case *github.AcceptedError:
+		return http.StatusAccepted
+	}
+	if resp == nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+// retry calls fn until it succeeds, returns a permanent error or the stage
+// runs out of attempts. It returns the number of attempts made and the last
+// error.
+func retry(ctx context.Context, stage string, fn func() error) (attempts int, err error) {
+	p, ok := retryPolicies[stage]
+	if !ok {
+		p = defaultRetryPolicy
+	}
+
+	start := time.Now()
+	defer func() {
+		result := "ok"
+		if err != nil {
+			result = "error"
+		}
+		stageDuration.since(start, stage, result)
+	}()
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return attempt, nil
+		}
+		class := classifyError(err)
+		if e, ok := err.(retryableError); ok {
+			err = e.error
+		}
+		if class == classPermanent || attempt >= p.attempts {
+			return attempt, err
+		}
+
+		wait := p.backoff(attempt)
+		if class == classRateLimited {
+			if w := rateLimitWait(err); w > wait {
+				wait = w
+			}
+			rateLimitWaits.inc(stage)
+			rateLimitWaitSeconds.add(wait.Seconds(), stage)
+		}
+		logrus.Debugf("%s: attempt %d/%d failed (%s), retrying in %s: %v", stage, attempt, p.attempts, class, wait, err)
+
+		select {
+		case <-ctx.Done():
+			return attempt, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func TestClassifyError(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want errorClass
+	}{
+		{"nil", nil, classPermanent},
+		{"plain", errors.New("boom"), classPermanent},
+		{"marked retryable", retryableError{errors.New("not found")}, classRetryable},
+		{"http 429", &httpError{StatusCode: http.StatusTooManyRequests}, classRateLimited},
+		{"http 502", &httpError{StatusCode: http.StatusBadGateway}, classRetryable},
+		{"http 404", &httpError{StatusCode: http.StatusNotFound}, classPermanent},
+		{"stage wraps http 503", &stageError{stageFork, 3, &httpError{StatusCode: http.StatusServiceUnavailable}}, classRetryable},
+		{"github rate limit", &github.RateLimitError{}, classRateLimited},
+		{"github abuse limit", &github.AbuseRateLimitError{}, classRateLimited},
+		{"github accepted", &github.AcceptedError{}, classRetryable},
+		{"github 500", &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusInternalServerError}}, classRetryable},
+		{"github 422", &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusUnprocessableEntity}}, classPermanent},
+		{"url wraps EOF", &url.Error{Op: "Get", URL: "https://example.com", Err: io.EOF}, classRetryable},
+		{"unexpected EOF", io.ErrUnexpectedEOF, classRetryable},
+		{"connection reset", syscall.ECONNRESET, classRetryable},
+		{"connection reset text", errors.New("read tcp: connection reset by peer"), classRetryable},
+	}
+
+	for _, tc := range testCases {
+		if got := classifyError(tc.err); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"plain", errors.New("boom"), 0},
+		{"http", &httpError{StatusCode: http.StatusForbidden}, http.StatusForbidden},
+		{"retryable http", retryableError{&httpError{StatusCode: http.StatusNotFound}}, http.StatusNotFound},
+		{"stage", &stageError{stageSync, 1, &httpError{StatusCode: http.StatusConflict}}, http.StatusConflict},
+		{"github", &github.ErrorResponse{Response: &http.Response{StatusCode: http.StatusUnprocessableEntity}}, http.StatusUnprocessableEntity},
+		{"github without response", &github.ErrorResponse{}, 0},
+		{"github accepted", &github.AcceptedError{}, http.StatusAccepted},
+	}
+
+	for _, tc := range testCases {
+		if got := errorStatus(tc.err); got != tc.want {
+			t.Errorf("%s: got %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{attempts: 10, base: time.Second, max: 10 * time.Second}
+	testCases := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		// the shift overflows, which must still be capped
+		{70, 10 * time.Second},
+	}
+
+	for _, tc := range testCases {
+		for i := 0; i < 100; i++ {
+			got := p.backoff(tc.attempt)
+			if got < tc.ceiling/2 || got > tc.ceiling {
+				t.Fatalf("attempt %d: got %s, want between %s and %s", tc.attempt, got, tc.ceiling/2, tc.ceiling)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	retryPolicies["test"] = retryPolicy{attempts: 3, base: time.Millisecond, max: time.Millisecond}
+	defer delete(retryPolicies, "test")
+
+	testCases := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"succeeds at once", nil, 1, nil},
+		{"succeeds after a retry", []error{io.EOF}, 2, nil},
+		{"gives up on a permanent error", []error{errNotFound}, 1, errNotFound},
+		{"runs out of attempts", []error{io.EOF, io.EOF, io.EOF, io.EOF}, 3, io.EOF},
+		{"unwraps retryable errors", []error{retryableError{errNotFound}, retryableError{errNotFound}, retryableError{errNotFound}}, 3, errNotFound},
+	}
+
+	for _, tc := range testCases {
+		calls := 0
+		attempts, err := retry(context.Background(), "test", func() error {
+			calls++
+			if calls <= len(tc.errs) {
+				return tc.errs[calls-1]
+			}
+			return nil
+		})
+		if attempts != tc.wantAttempts || attempts != calls {
+			t.Errorf("%s: got %d attempts and %d calls, want %d", tc.name, attempts, calls, tc.wantAttempts)
+		}
+		if err != tc.wantErr {
+			t.Errorf("%s: got error %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+var errNotFound = fmt.Errorf("not found")
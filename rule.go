@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rule rewrites a single file in a repository.
+type rule struct {
+	// Name identifies the rule in logs and in the state file.
+	Name string
+	// Version is bumped whenever the rule changes what it writes.
+	Version int
+	// Path is the file the rule rewrites.
+	Path string
+	// Old is replaced with New everywhere in the file.
+	Old string
+	New string
+	// AutoMergeOrgs are the owners whose repos get the rule's PRs merged
+	// as soon as checks and reviews allow.
+	AutoMergeOrgs []string
+
+	// Rationale explains why the change is needed and Links point at more
+	// background. Both are available to the templates.
+	Rationale string
+	Links     []string
+	// CommitType is the Conventional Commits type used in repos that
+	// follow them.
+	CommitType string
+	// Templates for the PR and the commit, see templateData.
+	Title  string
+	Body   string
+	Commit string
+
+	// campaign is the campaign the rule runs in, recorded in the trailers
+	// of its commits.
+	campaign string
+}
+
+// golintImportRule moves golint to its new import path.
+var golintImportRule = &rule{
+	Name:    "golint-import",
+	Version: 1,
+	Path:    ".travis.yml",
+	Old:     "github.com/golang/lint/golint",
+	New:     "golang.org/x/lint/golint",
+
+	Rationale: "golint moved to golang.org/x/lint/golint, and the old import path no longer builds.",
+	Links:     []string{"https://github.com/golang/lint"},
+
+	CommitType: "ci",
+	Title:      "Fix golint import path",
+	Commit:     "Fix golint import path",
+	Body: `{{.Rule.Rationale}}
+
+This updates {{range $i, $f := .Files}}{{if $i}}, {{end}}` + "`{{$f.Path}}`" + `{{end}} to use the new import path ({{.DiffStat}}).
+{{range .Rule.Links}}
+- {{.}}{{end}}`,
+}
+
+// rules are all the rules the bot knows about.
+var rules = []*rule{golintImportRule}
+
+// findRule returns the rule called name, or nil.
+func findRule(name string) *rule {
+	for _, r := range rules {
+		if r.Name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// parseAutoMerge fills in AutoMergeOrgs from the -automerge flag, a comma
+// separated list of rule:org entries. A bare org applies to every rule.
+func parseAutoMerge(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		targets, org := rules, entry
+		if i := strings.Index(entry, ":"); i >= 0 {
+			r := findRule(entry[:i])
+			if r == nil {
+				return fmt.Errorf("unknown rule %q in -automerge", entry[:i])
+			}
+			targets, org = []*rule{r}, entry[i+1:]
+		}
+		for _, r := range targets {
+			r.AutoMergeOrgs = append(r.AutoMergeOrgs, org)
+		}
+	}
+	return nil
+}
+
+// autoMerges reports whether PRs from r against a repo of owner may be
+// merged automatically. On GitLab owner can be a subgroup, which is covered
+// by its top level group.
+func (r *rule) autoMerges(owner string) bool {
+	top := strings.SplitN(owner, "/", 2)[0]
+	for _, org := range r.AutoMergeOrgs {
+		if strings.EqualFold(org, owner) || strings.EqualFold(org, top) {
+			return true
+		}
+	}
+	return false
+}
+
+// matches reports whether content still contains what the rule rewrites.
+func (r *rule) matches(content string) bool {
+	return strings.Contains(content, r.Old)
+}
+
+// apply returns the rewritten content and whether it differs from the
+// original. Only a non-empty diff is worth a commit.
+func (r *rule) apply(content string) (string, bool) {
+	fixed := strings.Replace(content, r.Old, r.New, -1)
+	return fixed, fixed != content
+}
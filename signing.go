@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/ssh"
+)
+
+// commitSigner signs the raw bytes of a commit object and returns the
+// armored signature git stores in its gpgsig header.
+type commitSigner interface {
+	Sign(payload []byte) (string, error)
+}
+
+// loadSigner reads the signing key at path. format is "openpgp", "ssh" or
+// empty to tell from the key. The passphrase is read from
+// SIGNING_KEY_PASSPHRASE for encrypted keys.
+func loadSigner(path, format string) (commitSigner, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	passphrase := []byte(os.Getenv("SIGNING_KEY_PASSPHRASE"))
+
+	if format == "" {
+		format = "ssh"
+		if bytes.Contains(b, []byte("BEGIN PGP PRIVATE KEY BLOCK")) {
+			format = "openpgp"
+		}
+	}
+
+	switch format {
+	case "openpgp":
+		return newPGPSigner(b, passphrase)
+	case "ssh":
+		return newSSHSigner(b, passphrase)
+	}
+	return nil, fmt.Errorf("unknown signing format %q, must be openpgp or ssh", format)
+}
+
+// pgpSigner signs commits with an OpenPGP key like git does with gpg.
+type pgpSigner struct {
+	entity *openpgp.Entity
+}
+
+func newPGPSigner(key, passphrase []byte) (*pgpSigner, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entities {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			if err := e.PrivateKey.Decrypt(passphrase); err != nil {
+				return nil, fmt.Errorf("decrypting OpenPGP key failed: %v", err)
+			}
+		}
+		for _, sub := range e.Subkeys {
+			if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+				if err := sub.PrivateKey.Decrypt(passphrase); err != nil {
+					return nil, fmt.Errorf("decrypting OpenPGP subkey failed: %v", err)
+				}
+			}
+		}
+		return &pgpSigner{entity: e}, nil
+	}
+	return nil, fmt.Errorf("no OpenPGP private key found")
+}
+
+func (s *pgpSigner) Sign(payload []byte) (string, error) {
+	var buf bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&buf, s.entity, bytes.NewReader(payload), nil); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// sshSigner signs commits in the SSHSIG format git uses with
+// gpg.format=ssh.
+type sshSigner struct {
+	signer ssh.Signer
+}
+
+// sshsigNamespace is the namespace git signs commits in.
+const sshsigNamespace = "git"
+
+func newSSHSigner(key, passphrase []byte) (*sshSigner, error) {
+	var (
+		signer ssh.Signer
+		err    error
+	)
+	if len(passphrase) > 0 {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, passphrase)
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// SSHSIG needs SHA-2 signatures, which ssh.Signer can't make for RSA.
+	if signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		return nil, fmt.Errorf("RSA SSH keys are not supported for signing, use an ed25519 or ECDSA key")
+	}
+	return &sshSigner{signer: signer}, nil
+}
+
+func (s *sshSigner) Sign(payload []byte) (string, error) {
+	hash := sha512.Sum512(payload)
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Hash      []byte
+	}{sshsigNamespace, "", "sha512", hash[:]})...)
+
+	sig, err := s.signer.Sign(rand.Reader, signed)
+	if err != nil {
+		return "", err
+	}
+
+	blob := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Version   uint32
+		PublicKey []byte
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Signature []byte
+	}{1, s.signer.PublicKey().Marshal(), sshsigNamespace, "", "sha512", ssh.Marshal(sig)})...)
+
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	var buf strings.Builder
+	buf.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(encoded) > 70 {
+		buf.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	buf.WriteString(encoded + "\n-----END SSH SIGNATURE-----\n")
+	return buf.String(), nil
+}
+
+// commitPayload builds the commit object git hashes and signs.
+func commitPayload(tree string, parents []string, author, committer *commitIdentity, when time.Time, message string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "tree %s\n", tree)
+	for _, p := range parents {
+		fmt.Fprintf(&buf, "parent %s\n", p)
+	}
+	stamp := when.Format("-0700")
+	fmt.Fprintf(&buf, "author %s <%s> %d %s\n", author.Name, author.Email, when.Unix(), stamp)
+	fmt.Fprintf(&buf, "committer %s <%s> %d %s\n", committer.Name, committer.Email, when.Unix(), stamp)
+	buf.WriteString("\n")
+	buf.WriteString(message)
+	return buf.Bytes()
+}
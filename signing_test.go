@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHSignerSign(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n\nFix it\n")
+
+	armored, err := (&sshSigner{signer: signer}).Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(armored, "\n"), "\n")
+	if lines[0] != "-----BEGIN SSH SIGNATURE-----" || lines[len(lines)-1] != "-----END SSH SIGNATURE-----" {
+		t.Fatalf("signature is not armored:\n%s", armored)
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		if len(line) > 70 {
+			t.Errorf("armor line is %d characters long, want at most 70", len(line))
+		}
+	}
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(lines[1:len(lines)-1], ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(blob, []byte("SSHSIG")) {
+		t.Fatalf("signature blob does not start with the SSHSIG magic")
+	}
+
+	var sig struct {
+		Version   uint32
+		PublicKey []byte
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Signature []byte
+	}
+	if err := ssh.Unmarshal(blob[len("SSHSIG"):], &sig); err != nil {
+		t.Fatal(err)
+	}
+	if sig.Version != 1 || sig.Namespace != "git" || sig.HashAlg != "sha512" {
+		t.Errorf("got version %d, namespace %q and hash %q, want 1, git and sha512", sig.Version, sig.Namespace, sig.HashAlg)
+	}
+	if !bytes.Equal(sig.PublicKey, signer.PublicKey().Marshal()) {
+		t.Error("signature carries another public key")
+	}
+
+	// Verify the way ssh-keygen -Y verify does, over the hash of payload.
+	var inner ssh.Signature
+	if err := ssh.Unmarshal(sig.Signature, &inner); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha512.Sum512(payload)
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace string
+		Reserved  string
+		HashAlg   string
+		Hash      []byte
+	}{"git", "", "sha512", hash[:]})...)
+	if err := signer.PublicKey().Verify(signed, &inner); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestPGPSignerSign(t *testing.T) {
+	entity, err := openpgp.NewEntity("Bot", "", "bot@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("tree 4b825dc642cb6eb9a060e54bf8d69288fbee4904\n\nFix it\n")
+
+	armored, err := (&pgpSigner{entity: entity}).Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(armored, "-----BEGIN PGP SIGNATURE-----") {
+		t.Fatalf("signature is not armored:\n%s", armored)
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{entity}, bytes.NewReader(payload), strings.NewReader(armored)); err != nil {
+		t.Errorf("signature does not verify: %v", err)
+	}
+}
+
+func TestLoadSigner(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, b, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPath := write("ecdsa", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPath := write("rsa", pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+
+	entity, err := openpgp.NewEntity("Bot", "", "bot@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pgpKey bytes.Buffer
+	w, err := armor.Encode(&pgpKey, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := entity.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	pgpPath := write("pgp", pgpKey.Bytes())
+
+	testCases := []struct {
+		name    string
+		path    string
+		format  string
+		want    string
+		wantErr string
+	}{
+		{name: "ssh key told from the content", path: ecPath, want: "ssh"},
+		{name: "openpgp key told from the content", path: pgpPath, want: "openpgp"},
+		{name: "explicit format", path: pgpPath, format: "openpgp", want: "openpgp"},
+		{name: "wrong explicit format", path: pgpPath, format: "ssh", wantErr: "no key found"},
+		{name: "RSA ssh keys", path: rsaPath, wantErr: "RSA SSH keys are not supported"},
+		{name: "unknown format", path: ecPath, format: "x509", wantErr: "unknown signing format"},
+		{name: "missing file", path: filepath.Join(dir, "missing"), wantErr: "no such file"},
+	}
+
+	for _, tc := range testCases {
+		signer, err := loadSigner(tc.path, tc.format)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got error %v, want one containing %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		got := "ssh"
+		if _, ok := signer.(*pgpSigner); ok {
+			got = "openpgp"
+		}
+		if got != tc.want {
+			t.Errorf("%s: got a %s signer, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCommitPayload(t *testing.T) {
+	author := &commitIdentity{Name: "Bot", Email: "bot@example.com"}
+	committer := &commitIdentity{Name: "Fixer", Email: "fixer@example.com"}
+	when := time.Date(2018, 10, 17, 12, 0, 0, 0, time.FixedZone("", 2*60*60))
+
+	testCases := []struct {
+		name    string
+		parents []string
+		want    string
+	}{
+		{
+			name:    "one parent",
+			parents: []string{"p1"},
+			want: "tree t1\nparent p1\n" +
+				"author Bot <bot@example.com> 1539770400 +0200\n" +
+				"committer Fixer <fixer@example.com> 1539770400 +0200\n" +
+				"\nFix it\n",
+		},
+		{
+			name:    "root commit",
+			parents: nil,
+			want: "tree t1\n" +
+				"author Bot <bot@example.com> 1539770400 +0200\n" +
+				"committer Fixer <fixer@example.com> 1539770400 +0200\n" +
+				"\nFix it\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := string(commitPayload("t1", tc.parents, author, committer, when, "Fix it\n")); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
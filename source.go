@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// source discovers candidate repositories for the pipeline.
+type source interface {
+	// Name describes the source for logging.
+	Name() string
+	// Repos calls found for every candidate repository until the source is
+	// exhausted or found returns false.
+	Repos(ctx context.Context, f forge, found func(*forgeRepo) bool) error
+}
+
+// newSource picks the discovery source based on the global flags.
+func newSource() (source, error) {
+	return newSourceFrom(repoName, reposFile, owner, searchQuery, pageStart)
+}
+
+// newSourceFrom picks the discovery source for a single repo, a file of
+// repos or an owner. Code search for query is used when none is given.
+func newSourceFrom(repoName, reposFile, owner, query string, page int) (source, error) {
+	var sources []source
+	if repoName != "" {
+		sources = append(sources, &singleSource{name: repoName})
+	}
+	if reposFile != "" {
+		sources = append(sources, &fileSource{path: reposFile})
+	}
+	if owner != "" {
+		sources = append(sources, &ownerSource{owner: owner})
+	}
+
+	switch len(sources) {
+	case 0:
+		return &searchSource{query: query, page: page}, nil
+	case 1:
+		return sources[0], nil
+	}
+	return nil, fmt.Errorf("only one of -repo, -repos-file and -owner can be given")
+}
+
+// searchSource finds repositories with the forge's code search.
+type searchSource struct {
+	query string
+	page  int
+}
+
+func (s *searchSource) Name() string { return fmt.Sprintf("code search %q", s.query) }
+
+func (s *searchSource) Repos(ctx context.Context, f forge, found func(*forgeRepo) bool) error {
+	err := f.Search(ctx, s.query, s.page, found)
+	logrus.Debug("Done searching!")
+	return err
+}
+
+// singleSource yields one repository given as owner/name.
+type singleSource struct {
+	name string
+}
+
+func (s *singleSource) Name() string { return s.name }
+
+func (s *singleSource) Repos(ctx context.Context, f forge, found func(*forgeRepo) bool) error {
+	repo, err := getRepo(ctx, f, s.name)
+	if err != nil {
+		return err
+	}
+	found(repo)
+	return nil
+}
+
+// fileSource reads owner/name lines, or JSON lines with a "repo" or
+// "full_name" field, from a file or from stdin when the path is "-".
+type fileSource struct {
+	path string
+}
+
+func (s *fileSource) Name() string {
+	if s.path == "-" {
+		return "stdin"
+	}
+	return s.path
+}
+
+func (s *fileSource) Repos(ctx context.Context, f forge, found func(*forgeRepo) bool) error {
+	var r io.Reader = os.Stdin
+	if s.path != "-" {
+		file, err := os.Open(s.path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		name, err := parseRepoLine(scanner.Text())
+		if err != nil {
+			logrus.Warnf("%s:%d: %v", s.Name(), line, err)
+			continue
+		}
+		if name == "" {
+			continue
+		}
+
+		repo, err := getRepo(ctx, f, name)
+		if err != nil {
+			logrus.Warnf("%s:%d: %v", s.Name(), line, err)
+			continue
+		}
+		if !found(repo) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// parseRepoLine returns the owner/name on a line of a repo list. Blank lines
+// and lines starting with # return an empty name.
+func parseRepoLine(line string) (string, error) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", nil
+	}
+	if !strings.HasPrefix(line, "{") {
+		return line, nil
+	}
+
+	var v struct {
+		Repo     string `json:"repo"`
+		FullName string `json:"full_name"`
+	}
+	if err := json.Unmarshal([]byte(line), &v); err != nil {
+		return "", err
+	}
+	if v.Repo != "" {
+		return v.Repo, nil
+	}
+	if v.FullName != "" {
+		return v.FullName, nil
+	}
+	return "", fmt.Errorf("no repo or full_name field")
+}
+
+// ownerSource yields every repository of a user or organization.
+type ownerSource struct {
+	owner string
+}
+
+func (s *ownerSource) Name() string { return s.owner }
+
+func (s *ownerSource) Repos(ctx context.Context, f forge, found func(*forgeRepo) bool) error {
+	return f.ListRepos(ctx, s.owner, found)
+}
+
+// getRepo fetches a repository by its owner/name.
+func getRepo(ctx context.Context, f forge, fullName string) (*forgeRepo, error) {
+	repo, _, err := fetchRepo(ctx, f, fullName)
+	return repo, err
+}
+
+// fetchRepo is getRepo that also returns the attempts made, for the
+// pipeline to record with a failure.
+func fetchRepo(ctx context.Context, f forge, fullName string) (*forgeRepo, int, error) {
+	owner, name, err := splitRepoName(fullName)
+	if err != nil {
+		return nil, 1, err
+	}
+
+	var repo *forgeRepo
+	attempts, err := retry(ctx, stageContent, func() error {
+		var err error
+		repo, err = f.GetRepo(ctx, owner, name)
+		return err
+	})
+	return repo, attempts, err
+}
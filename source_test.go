@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRepoLine(t *testing.T) {
+	testCases := []struct {
+		line    string
+		want    string
+		wantErr string
+	}{
+		{line: "", want: ""},
+		{line: "   ", want: ""},
+		{line: "# a comment", want: ""},
+		{line: "  owner/repo  ", want: "owner/repo"},
+		{line: `{"repo": "owner/repo"}`, want: "owner/repo"},
+		{line: `{"full_name": "owner/repo", "stars": 3}`, want: "owner/repo"},
+		{line: `{"repo": "a/b", "full_name": "c/d"}`, want: "a/b"},
+		{line: `{"name": "repo"}`, wantErr: "no repo or full_name field"},
+		{line: `{"repo": `, wantErr: "unexpected end of JSON input"},
+	}
+
+	for _, tc := range testCases {
+		got, err := parseRepoLine(tc.line)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%q: got error %v, want one containing %q", tc.line, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("%q: got %q and error %v, want %q", tc.line, got, err, tc.want)
+		}
+	}
+}
+
+func TestSplitRepoName(t *testing.T) {
+	testCases := []struct {
+		name      string
+		wantOwner string
+		wantName  string
+		wantErr   bool
+	}{
+		{name: "owner/repo", wantOwner: "owner", wantName: "repo"},
+		{name: " owner/repo\n", wantOwner: "owner", wantName: "repo"},
+		{name: "group/subgroup/repo", wantOwner: "group/subgroup", wantName: "repo"},
+		{name: "repo", wantErr: true},
+		{name: "/repo", wantErr: true},
+		{name: "owner/", wantErr: true},
+		{name: "", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		owner, name, err := splitRepoName(tc.name)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: got error %v, want error %t", tc.name, err, tc.wantErr)
+			continue
+		}
+		if owner != tc.wantOwner || name != tc.wantName {
+			t.Errorf("%q: got %q and %q, want %q and %q", tc.name, owner, name, tc.wantOwner, tc.wantName)
+		}
+	}
+}
+
+func TestNewSourceFrom(t *testing.T) {
+	testCases := []struct {
+		name      string
+		repoName  string
+		reposFile string
+		owner     string
+		want      source
+		wantErr   bool
+	}{
+		{name: "nothing given", want: &searchSource{query: "q", page: 2}},
+		{name: "single repo", repoName: "a/b", want: &singleSource{name: "a/b"}},
+		{name: "repos file", reposFile: "-", want: &fileSource{path: "-"}},
+		{name: "owner", owner: "a", want: &ownerSource{owner: "a"}},
+		{name: "more than one", repoName: "a/b", owner: "a", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		got, err := newSourceFrom(tc.repoName, tc.reposFile, tc.owner, "q", 2)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error %t", tc.name, err, tc.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// reposForge knows a fixed set of repositories. Every other forge method
+// panics.
+type reposForge struct {
+	forge
+	repos map[string]bool
+}
+
+func (f *reposForge) GetRepo(ctx context.Context, owner, name string) (*forgeRepo, error) {
+	if !f.repos[owner+"/"+name] {
+		return nil, errNotFound
+	}
+	return &forgeRepo{Owner: owner, Name: name}, nil
+}
+
+func TestFileSourceRepos(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "repos")
+	lines := []string{
+		"# repos to fix",
+		"a/one",
+		"",
+		`{"full_name": "a/two"}`,
+		"not a repo",
+		"a/missing",
+		`{"broken": `,
+		"a/three",
+		"a/four",
+	}
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := &reposForge{repos: map[string]bool{"a/one": true, "a/two": true, "a/three": true, "a/four": true}}
+
+	var got []string
+	err := (&fileSource{path: path}).Repos(context.Background(), f, func(repo *forgeRepo) bool {
+		got = append(got, repo.FullName())
+		// stop after the third repo
+		return len(got) < 3
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a/one", "a/two", "a/three"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// repoState holds what the bot knows about a single upstream repository.
+type repoState struct {
+	Repo      string    `json:"repo"`
+	Stage     string    `json:"stage,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	Failure   string    `json:"failure,omitempty"`
+	Class     string    `json:"class,omitempty"`
+	Skipped   string    `json:"skipped,omitempty"`
+	PR        *prState  `json:"pr,omitempty"`
+	Info      *repoInfo `json:"info,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// repoInfo is what reports break outcomes down by, as it was when the PR
+// was opened.
+type repoInfo struct {
+	Stars      int      `json:"stars"`
+	GoVersions []string `json:"go_versions,omitempty"`
+}
+
+// stateStore is a small JSON file backed store shared by the pipeline and
+// the subcommands.
+type stateStore struct {
+	path string
+	mu   sync.Mutex
+
+	Repos       map[string]*repoState  `json:"repos"`
+	DeadLetters map[string]*deadLetter `json:"dead_letters,omitempty"`
+	Forks       map[int64]*forkRecord  `json:"forks,omitempty"`
+	// Denylist holds the owners the bot never opens PRs against. Only the
+	// -state file's list is used.
+	Denylist []string `json:"denylist,omitempty"`
+}
+
+func openStateStore(path string) (*stateStore, error) {
+	s := &stateStore{
+		path:        path,
+		Repos:       map[string]*repoState{},
+		DeadLetters: map[string]*deadLetter{},
+		Forks:       map[int64]*forkRecord{},
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Repos == nil {
+		s.Repos = map[string]*repoState{}
+	}
+	if s.DeadLetters == nil {
+		s.DeadLetters = map[string]*deadLetter{}
+	}
+	if s.Forks == nil {
+		s.Forks = map[int64]*forkRecord{}
+	}
+	return s, nil
+}
+
+// repo returns the state for name, creating it if needed. The caller must
+// hold s.mu.
+func (s *stateStore) repo(name string) *repoState {
+	r, ok := s.Repos[name]
+	if !ok {
+		r = &repoState{Repo: name}
+		s.Repos[name] = r
+	}
+	return r
+}
+
+// recordFailure stores the final failure reason for a repo and puts it on
+// the dead-letter queue.
+func (s *stateStore) recordFailure(name, stage string, attempts int, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	r := s.repo(name)
+	r.Stage = stage
+	r.Attempts = attempts
+	r.Failure = err.Error()
+	r.Class = classifyError(err).String()
+	r.Skipped = ""
+	r.UpdatedAt = now
+
+	s.DeadLetters[name] = &deadLetter{
+		Repo:     name,
+		Stage:    stage,
+		Error:    err.Error(),
+		Status:   errorStatus(err),
+		Attempts: attempts,
+		FailedAt: now,
+	}
+	return s.save()
+}
+
+// recordStage marks a repo as having successfully reached stage and takes
+// it off the dead-letter queue.
+func (s *stateStore) recordStage(name, stage string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.DeadLetters, name)
+	r := s.repo(name)
+	r.Stage = stage
+	r.Attempts = 0
+	r.Failure = ""
+	r.Class = ""
+	r.Skipped = ""
+	r.UpdatedAt = time.Now().UTC()
+	return s.save()
+}
+
+// recordSkip stores why the pipeline decided to leave a repo alone.
+func (s *stateStore) recordSkip(name, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.DeadLetters, name)
+	r := s.repo(name)
+	r.Stage = stageSkipped
+	r.Attempts = 0
+	r.Failure = ""
+	r.Class = ""
+	r.Skipped = reason
+	r.UpdatedAt = time.Now().UTC()
+	return s.save()
+}
+
+// recordRepoInfo stores the stars and Go versions of a repo.
+func (s *stateStore) recordRepoInfo(name string, info *repoInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.repo(name).Info = info
+	return s.save()
+}
+
+// deny adds owners to the denylist.
+func (s *stateStore) deny(owners ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, owner := range owners {
+		if !s.deniedLocked(owner) {
+			s.Denylist = append(s.Denylist, owner)
+		}
+	}
+	return s.save()
+}
+
+// denied reports whether owner is on the denylist.
+func (s *stateStore) denied(owner string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.deniedLocked(owner)
+}
+
+func (s *stateStore) deniedLocked(owner string) bool {
+	for _, o := range s.Denylist {
+		if strings.EqualFold(o, owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// save writes the store to disk. The caller must hold s.mu.
+func (s *stateStore) save() error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
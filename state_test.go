@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateStoreDeadLetters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	s, err := openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := &httpError{Method: "POST", URL: "repos/a/b/forks", StatusCode: http.StatusBadGateway, Message: "bad gateway"}
+	if err := s.recordFailure("a/b", stageFork, 3, failure); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.recordFailure("a/c", stageCommit, 1, errNotFound); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.recordStage("a/c", stagePullRequest); err != nil {
+		t.Fatal(err)
+	}
+
+	// what was saved must survive reopening the file
+	s, err = openStateStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dl, ok := s.DeadLetters["a/b"]
+	if !ok {
+		t.Fatal("a/b is not on the dead-letter queue")
+	}
+	if dl.Stage != stageFork || dl.Attempts != 3 || dl.Status != http.StatusBadGateway {
+		t.Errorf("got dead letter %+v, want stage %s, 3 attempts and status %d", dl, stageFork, http.StatusBadGateway)
+	}
+	if r := s.Repos["a/b"]; r.Class != classRetryable.String() || r.Attempts != 3 {
+		t.Errorf("got state %+v, want class %s and 3 attempts", r, classRetryable)
+	}
+	if _, ok := s.DeadLetters["a/c"]; ok {
+		t.Error("a/c is still on the dead-letter queue after reaching a later stage")
+	}
+	if r := s.Repos["a/c"]; r.Stage != stagePullRequest || r.Failure != "" {
+		t.Errorf("got state %+v, want stage %s without a failure", r, stagePullRequest)
+	}
+
+	if err := s.recordSkip("a/b", "no rule matches any more"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.DeadLetters["a/b"]; ok {
+		t.Error("a/b is still on the dead-letter queue after being skipped")
+	}
+	if r := s.Repos["a/b"]; r.Stage != stageSkipped || r.Skipped == "" {
+		t.Errorf("got state %+v, want it skipped", r)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const surveyHelp = `Measure how widespread the patterns of the rules are.
+
+Runs discovery and the rules against every repository found, without
+forking, committing or writing to the state file, and sums up the matching
+repositories by rule, file type, oldest Go version, stars and activity.
+
+Repositories come from -repo, -repos-file or -owner, or code search when
+none is given.`
+
+func (cmd *surveyCommand) Name() string      { return "survey" }
+func (cmd *surveyCommand) Args() string      { return "[-format <format>] [-o <file>] [-limit <n>]" }
+func (cmd *surveyCommand) ShortHelp() string { return "Survey how many repos the rules match." }
+func (cmd *surveyCommand) LongHelp() string  { return surveyHelp }
+func (cmd *surveyCommand) Hidden() bool      { return false }
+
+func (cmd *surveyCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.format, "format", "text", "output format: text, json or csv (one row per matching repo)")
+	fs.StringVar(&cmd.out, "o", "", "write the results to this file instead of stdout")
+	fs.IntVar(&cmd.limit, "limit", 0, "stop after looking at this many repos, 0 for no limit")
+}
+
+type surveyCommand struct {
+	format string
+	out    string
+	limit  int
+}
+
+func (cmd *surveyCommand) Run(ctx context.Context, args []string) error {
+	write, ok := surveyWriters[cmd.format]
+	if !ok {
+		return fmt.Errorf("unknown survey format %q, must be text, json or csv", cmd.format)
+	}
+	src, err := newSource()
+	if err != nil {
+		return err
+	}
+	f, err := connectForge(ctx)
+	if err != nil {
+		return err
+	}
+
+	result, err := survey(ctx, f, src, cmd.limit)
+	if err != nil {
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+	if cmd.out != "" {
+		file, err := os.Create(cmd.out)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	return write(out, result)
+}
+
+// surveyRepo is a repository at least one rule matches.
+type surveyRepo struct {
+	Repo       string    `json:"repo"`
+	URL        string    `json:"url"`
+	Stars      int       `json:"stars"`
+	PushedAt   time.Time `json:"pushed_at,omitempty"`
+	Archived   bool      `json:"archived,omitempty"`
+	Fork       bool      `json:"fork,omitempty"`
+	Rules      []string  `json:"rules"`
+	Files      []string  `json:"files"`
+	GoVersions []string  `json:"go_versions,omitempty"`
+}
+
+// surveyCount is the number of matching repos in a group.
+type surveyCount struct {
+	Name  string `json:"name"`
+	Repos int    `json:"repos"`
+}
+
+type surveyResult struct {
+	Source      string        `json:"source"`
+	Scanned     int           `json:"scanned"`
+	Matching    int           `json:"matching"`
+	Archived    int           `json:"archived"`
+	ByRule      []surveyCount `json:"by_rule"`
+	ByFileType  []surveyCount `json:"by_file_type"`
+	ByGoVersion []surveyCount `json:"by_go_version"`
+	ByStars     []surveyCount `json:"by_stars"`
+	ByActivity  []surveyCount `json:"by_activity"`
+	Repos       []*surveyRepo `json:"repos"`
+}
+
+// activityBuckets group repos by their last push, in the order they are
+// reported.
+var activityBuckets = []struct {
+	name   string
+	within time.Duration
+}{
+	{"last 30 days", 30 * 24 * time.Hour},
+	{"last year", 365 * 24 * time.Hour},
+	{"1-2 years", 2 * 365 * 24 * time.Hour},
+}
+
+func activityBucket(pushed time.Time) string {
+	if pushed.IsZero() {
+		return "unknown"
+	}
+	age := time.Since(pushed)
+	for _, b := range activityBuckets {
+		if age <= b.within {
+			return b.name
+		}
+	}
+	return "over 2 years"
+}
+
+// survey runs every rule against the repos src finds, up to limit of them,
+// and sums up the ones that match. Nothing is written anywhere.
+func survey(ctx context.Context, f forge, src source, limit int) (*surveyResult, error) {
+	result := &surveyResult{Source: src.Name()}
+	var (
+		seen       = map[string]bool{}
+		byRule     = map[string]int{}
+		byFileType = map[string]int{}
+		byGo       = map[string]int{}
+		byStars    = map[string]int{}
+		byActivity = map[string]int{}
+	)
+
+	logrus.Infof("Surveying repositories from %s", src.Name())
+	err := src.Repos(ctx, f, func(repo *forgeRepo) bool {
+		name := repo.FullName()
+		if seen[name] {
+			return true
+		}
+		seen[name] = true
+		result.Scanned++
+		if result.Scanned%100 == 0 {
+			logrus.Infof("Surveyed %d repositories, %d match", result.Scanned, result.Matching)
+		}
+
+		sr := surveyOne(ctx, f, repo)
+		if sr != nil {
+			result.Matching++
+			result.Repos = append(result.Repos, sr)
+			if sr.Archived {
+				result.Archived++
+			}
+			for _, r := range sr.Rules {
+				byRule[r]++
+			}
+			types := map[string]bool{}
+			for _, p := range sr.Files {
+				types[fileType(p)] = true
+			}
+			for t := range types {
+				byFileType[t]++
+			}
+			info := &repoInfo{Stars: sr.Stars, GoVersions: sr.GoVersions}
+			byGo[goVersionBucket(info)]++
+			byStars[starBucket(info)]++
+			byActivity[activityBucket(sr.PushedAt)]++
+		}
+		return limit <= 0 || result.Scanned < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result.ByRule = sortedCounts(byRule, nil)
+	result.ByFileType = sortedCounts(byFileType, nil)
+	result.ByGoVersion = sortedCounts(byGo, versionLess)
+	var starOrder, activityOrder []string
+	for _, b := range starBuckets {
+		starOrder = append(starOrder, b.name)
+	}
+	result.ByStars = sortedCounts(byStars, orderOf(append(starOrder, "unknown")))
+	for _, b := range activityBuckets {
+		activityOrder = append(activityOrder, b.name)
+	}
+	activityOrder = append(activityOrder, "over 2 years", "unknown")
+	result.ByActivity = sortedCounts(byActivity, orderOf(activityOrder))
+	return result, nil
+}
+
+// surveyOne runs every rule against repo and returns what it found, or
+// nil if no rule matches.
+func surveyOne(ctx context.Context, f forge, repo *forgeRepo) *surveyRepo {
+	files := map[string]*forgeFile{}
+	read := func(p string) *forgeFile {
+		file, ok := files[p]
+		if !ok {
+			file, _ = getFileContent(ctx, f, repo, p, "")
+			files[p] = file
+		}
+		return file
+	}
+
+	sr := &surveyRepo{Repo: repo.FullName()}
+	for _, r := range rules {
+		file := read(r.Path)
+		if file == nil || !r.matches(file.Content) {
+			continue
+		}
+		if _, changed := r.apply(file.Content); !changed {
+			continue
+		}
+		sr.Rules = append(sr.Rules, r.Name)
+		sr.Files = append(sr.Files, file.Path)
+	}
+	if len(sr.Rules) == 0 {
+		logrus.Debugf("%s: no rule matches", sr.Repo)
+		return nil
+	}
+	if travis := read(".travis.yml"); travis != nil {
+		sr.GoVersions = travisGoVersions(travis.Content)
+	}
+
+	// Code search results leave out most of the repository.
+	if repo.PushedAt.IsZero() {
+		if full, err := getRepo(ctx, f, sr.Repo); err == nil {
+			repo = full
+		} else {
+			logrus.Debugf("getting %s failed: %v", sr.Repo, err)
+		}
+	}
+	sr.URL = repo.HTMLURL
+	sr.Stars = repo.Stars
+	sr.PushedAt = repo.PushedAt
+	sr.Archived = repo.Archived
+	sr.Fork = repo.Fork
+	logrus.Debugf("%s: matches %s", sr.Repo, strings.Join(sr.Rules, ", "))
+	return sr
+}
+
+// fileType is the extension of p, or its name if it has none.
+func fileType(p string) string {
+	if ext := path.Ext(p); ext != "" && ext != path.Base(p) {
+		return ext
+	}
+	return path.Base(p)
+}
+
+// orderOf returns a less function putting names in the order given.
+func orderOf(names []string) func(a, b string) bool {
+	return func(a, b string) bool {
+		ia, ib := len(names), len(names)
+		for i, n := range names {
+			if n == a {
+				ia = i
+			}
+			if n == b {
+				ib = i
+			}
+		}
+		return ia < ib
+	}
+}
+
+// sortedCounts turns counts into a list ordered by less, or by the most
+// repos first when less is nil.
+func sortedCounts(counts map[string]int, less func(a, b string) bool) []surveyCount {
+	var list []surveyCount
+	for name, n := range counts {
+		list = append(list, surveyCount{Name: name, Repos: n})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if less != nil {
+			return less(list[i].Name, list[j].Name)
+		}
+		if list[i].Repos != list[j].Repos {
+			return list[i].Repos > list[j].Repos
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// surveyWriters write survey results in each of the supported formats.
+var surveyWriters = map[string]func(io.Writer, *surveyResult) error{
+	"text": writeSurveyText,
+	"csv":  writeSurveyCSV,
+	"json": func(w io.Writer, r *surveyResult) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	},
+}
+
+func writeSurveyText(w io.Writer, r *surveyResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	share := func(n int) string {
+		if r.Matching == 0 {
+			return ""
+		}
+		return fmt.Sprintf("%.1f%%", float64(n)*100/float64(r.Matching))
+	}
+
+	fmt.Fprintf(tw, "Source\t%s\n", r.Source)
+	fmt.Fprintf(tw, "Scanned\t%d\n", r.Scanned)
+	fmt.Fprintf(tw, "Matching\t%d\n", r.Matching)
+	fmt.Fprintf(tw, "Archived\t%d\t%s\n", r.Archived, share(r.Archived))
+	for _, section := range []struct {
+		title  string
+		counts []surveyCount
+	}{
+		{"RULE", r.ByRule},
+		{"FILE TYPE", r.ByFileType},
+		{"OLDEST GO", r.ByGoVersion},
+		{"STARS", r.ByStars},
+		{"LAST PUSH", r.ByActivity},
+	} {
+		fmt.Fprintf(tw, "\n%s\tREPOS\n", section.title)
+		for _, c := range section.counts {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", c.Name, c.Repos, share(c.Repos))
+		}
+	}
+	return tw.Flush()
+}
+
+// writeSurveyCSV writes one row per matching repo.
+func writeSurveyCSV(w io.Writer, r *surveyResult) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"repo", "url", "stars", "pushed_at", "archived", "fork", "rules", "files", "go_versions"})
+	for _, sr := range r.Repos {
+		pushed := ""
+		if !sr.PushedAt.IsZero() {
+			pushed = sr.PushedAt.Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			sr.Repo, sr.URL, strconv.Itoa(sr.Stars), pushed,
+			strconv.FormatBool(sr.Archived), strconv.FormatBool(sr.Fork),
+			strings.Join(sr.Rules, " "), strings.Join(sr.Files, " "), strings.Join(sr.GoVersions, " "),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/go-github/github"
+	"github.com/sirupsen/logrus"
+)
+
+// syncFork makes sure the default branch of fork points at the head of the
+// upstream default branch before we commit on or branch off it. A fork that
+// only lags behind is fast-forwarded. A fork whose extra commits were all
+// made by the bot is reset to the upstream head. Any other divergence is an
+// error, since resetting would throw away someone else's work. It returns
+// the attempts made at the step that failed.
+func syncFork(ctx context.Context, client *github.Client, fork *github.Repository) (int, error) {
+	parent := fork.GetParent()
+	if parent == nil {
+		return 1, fmt.Errorf("%s is not a fork", fork.GetFullName())
+	}
+	forkOwner, forkName := fork.GetOwner().GetLogin(), fork.GetName()
+
+	upstreamBranch := parent.GetDefaultBranch()
+	if upstreamBranch == "" {
+		upstreamBranch = "master"
+	}
+	// The fork starts out with the default branch of upstream, but keeps
+	// its own if upstream renames it later.
+	forkBranch := fork.GetDefaultBranch()
+	if forkBranch == "" {
+		forkBranch = upstreamBranch
+	}
+
+	var (
+		branch *github.Branch
+		ref    *github.Reference
+	)
+	attempts, err := retry(ctx, stageSync, func() error {
+		var err error
+		branch, _, err = client.Repositories.GetBranch(ctx, parent.GetOwner().GetLogin(), parent.GetName(), upstreamBranch)
+		return err
+	})
+	if err != nil {
+		return attempts, fmt.Errorf("getting upstream branch %s failed: %v", upstreamBranch, err)
+	}
+	attempts, err = retry(ctx, stageSync, func() error {
+		var err error
+		ref, _, err = client.Git.GetRef(ctx, forkOwner, forkName, "heads/"+forkBranch)
+		return err
+	})
+	if err != nil {
+		return attempts, fmt.Errorf("getting fork branch %s failed: %v", forkBranch, err)
+	}
+
+	upstreamSHA := branch.GetCommit().GetSHA()
+	forkSHA := ref.GetObject().GetSHA()
+	if upstreamSHA == forkSHA {
+		return attempts, nil
+	}
+
+	// Compare from the fork's point of view: "ahead" means upstream has
+	// commits the fork is missing.
+	var cmp *github.CommitsComparison
+	attempts, err = retry(ctx, stageSync, func() error {
+		var err error
+		cmp, _, err = client.Repositories.CompareCommits(ctx, forkOwner, forkName, forkSHA, upstreamSHA)
+		return err
+	})
+	if err != nil {
+		return attempts, fmt.Errorf("comparing %s with upstream failed: %v", fork.GetFullName(), err)
+	}
+
+	switch cmp.GetStatus() {
+	case "identical":
+		return attempts, nil
+	case "ahead":
+		logrus.Infof("Fast-forwarding %s, %d commits behind upstream", fork.GetFullName(), cmp.GetAheadBy())
+		return updateForkRef(ctx, client, fork, ref, upstreamSHA, false)
+	case "behind", "diverged":
+		foreign, attempts, err := foreignForkCommits(ctx, client, fork, upstreamSHA, forkSHA)
+		if err != nil {
+			return attempts, err
+		}
+		if foreign > 0 {
+			return 1, fmt.Errorf("%s has diverged from upstream with %d commits not made by the bot", fork.GetFullName(), foreign)
+		}
+		logrus.Infof("Resetting %s to upstream, dropping %d old bot commits", fork.GetFullName(), cmp.GetBehindBy())
+		return updateForkRef(ctx, client, fork, ref, upstreamSHA, true)
+	}
+	return 1, fmt.Errorf("unknown comparison status %q for %s", cmp.GetStatus(), fork.GetFullName())
+}
+
+// foreignForkCommits counts the commits on the fork that upstream does not
+// have and that were not made by the bot, and the attempts made at listing
+// them. Bot commits are told apart by their trailers, since they may be
+// authored as someone else.
+func foreignForkCommits(ctx context.Context, client *github.Client, fork *github.Repository, upstreamSHA, forkSHA string) (int, int, error) {
+	var cmp *github.CommitsComparison
+	attempts, err := retry(ctx, stageSync, func() error {
+		var err error
+		cmp, _, err = client.Repositories.CompareCommits(ctx, fork.GetOwner().GetLogin(), fork.GetName(), upstreamSHA, forkSHA)
+		return err
+	})
+	if err != nil {
+		return 0, attempts, fmt.Errorf("listing commits only on %s failed: %v", fork.GetFullName(), err)
+	}
+
+	foreign := 0
+	for _, c := range cmp.Commits {
+		if !madeByBot(c.GetCommit().GetMessage()) {
+			foreign++
+		}
+	}
+	return foreign, attempts, nil
+}
+
+func updateForkRef(ctx context.Context, client *github.Client, fork *github.Repository, ref *github.Reference, sha string, force bool) (int, error) {
+	ref.Object.SHA = &sha
+	attempts, err := retry(ctx, stageSync, func() error {
+		_, _, err := client.Git.UpdateRef(ctx, fork.GetOwner().GetLogin(), fork.GetName(), ref, force)
+		return err
+	})
+	if err != nil {
+		return attempts, fmt.Errorf("updating %s in %s failed: %v", ref.GetRef(), fork.GetFullName(), err)
+	}
+	return attempts, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+// fakeForkServer serves the GitHub API calls syncFork makes for the fork
+// bot/repo of up/repo. Fork commits not made by the bot have no trailers.
+type fakeForkServer struct {
+	upstreamBranch string
+	forkBranch     string
+	status         string
+	forkCommits    []string
+
+	// updated is the body of the ref update, if there was one.
+	updated map[string]interface{}
+}
+
+func (s *fakeForkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/repos/up/repo/branches/"+s.upstreamBranch:
+		fmt.Fprint(w, `{"name": "main", "commit": {"sha": "upstream"}}`)
+	case r.Method == "GET" && r.URL.Path == "/repos/bot/repo/git/refs/heads/"+s.forkBranch:
+		fmt.Fprintf(w, `{"ref": "refs/heads/%s", "object": {"sha": "fork"}}`, s.forkBranch)
+	case r.Method == "GET" && r.URL.Path == "/repos/bot/repo/compare/fork...upstream":
+		fmt.Fprintf(w, `{"status": %q, "ahead_by": 1, "behind_by": %d}`, s.status, len(s.forkCommits))
+	case r.Method == "GET" && r.URL.Path == "/repos/bot/repo/compare/upstream...fork":
+		var commits []map[string]interface{}
+		for _, message := range s.forkCommits {
+			commits = append(commits, map[string]interface{}{"commit": map[string]string{"message": message}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "ahead", "commits": commits})
+	case r.Method == "PATCH" && r.URL.Path == "/repos/bot/repo/git/refs/heads/"+s.forkBranch:
+		json.NewDecoder(r.Body).Decode(&s.updated)
+		fmt.Fprintf(w, `{"ref": "refs/heads/%s", "object": {"sha": "upstream"}}`, s.forkBranch)
+	default:
+		http.Error(w, `{"message": "Not Found"}`, http.StatusNotFound)
+	}
+}
+
+func TestSyncFork(t *testing.T) {
+	botCommit := "Fix import\n\nFixer-Rule: golint-import@v1"
+	testCases := []struct {
+		name           string
+		upstreamBranch string
+		forkBranch     string
+		status         string
+		forkCommits    []string
+		wantErr        string
+		wantForce      interface{}
+	}{
+		{
+			name:           "identical",
+			upstreamBranch: "main",
+			status:         "identical",
+		},
+		{
+			name:           "behind upstream is fast-forwarded",
+			upstreamBranch: "main",
+			status:         "ahead",
+			wantForce:      false,
+		},
+		{
+			name:           "fork keeps its own default branch",
+			upstreamBranch: "main",
+			forkBranch:     "master",
+			status:         "ahead",
+			wantForce:      false,
+		},
+		{
+			name:           "only bot commits are reset",
+			upstreamBranch: "main",
+			status:         "diverged",
+			forkCommits:    []string{botCommit, botCommit},
+			wantForce:      true,
+		},
+		{
+			name:           "foreign commits are kept",
+			upstreamBranch: "main",
+			status:         "diverged",
+			forkCommits:    []string{botCommit, "Someone else's work"},
+			wantErr:        "1 commits not made by the bot",
+		},
+		{
+			name:           "a message mentioning the trailer is not a bot commit",
+			upstreamBranch: "main",
+			status:         "behind",
+			forkCommits:    []string{"Remove the Fixer-Rule: trailer"},
+			wantErr:        "1 commits not made by the bot",
+		},
+	}
+
+	for _, tc := range testCases {
+		s := &fakeForkServer{upstreamBranch: tc.upstreamBranch, forkBranch: tc.forkBranch, status: tc.status, forkCommits: tc.forkCommits}
+		if s.forkBranch == "" {
+			s.forkBranch = tc.upstreamBranch
+		}
+		server := httptest.NewServer(s)
+		client := github.NewClient(nil)
+		client.BaseURL, _ = url.Parse(server.URL + "/")
+
+		fork := &github.Repository{
+			Name:          github.String("repo"),
+			FullName:      github.String("bot/repo"),
+			Owner:         &github.User{Login: github.String("bot")},
+			DefaultBranch: github.String(tc.forkBranch),
+			Parent: &github.Repository{
+				Name:          github.String("repo"),
+				Owner:         &github.User{Login: github.String("up")},
+				DefaultBranch: github.String(tc.upstreamBranch),
+			},
+		}
+		_, err := syncFork(context.Background(), client, fork)
+		server.Close()
+
+		switch {
+		case tc.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got error %v, want one containing %q", tc.name, err, tc.wantErr)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", tc.name, err)
+		case tc.wantForce == nil && s.updated != nil:
+			t.Errorf("%s: the fork was updated to %v", tc.name, s.updated)
+		case tc.wantForce != nil && s.updated == nil:
+			t.Errorf("%s: the fork was not updated", tc.name)
+		case tc.wantForce != nil && (s.updated["sha"] != "upstream" || s.updated["force"] != tc.wantForce):
+			t.Errorf("%s: got update %v, want sha upstream and force %v", tc.name, s.updated, tc.wantForce)
+		}
+	}
+}
+
+func TestForkBranch(t *testing.T) {
+	r := &rule{Name: "golint-import"}
+	testCases := []struct {
+		prefix        string
+		defaultBranch string
+		want          string
+	}{
+		{"", "main", "main"},
+		{"", "", "master"},
+		{"fix/", "main", "fix/golint-import"},
+	}
+
+	for _, tc := range testCases {
+		c := &campaign{branchPrefix: tc.prefix}
+		if got := c.forkBranch(r, &forgeRepo{DefaultBranch: tc.defaultBranch}); got != tc.want {
+			t.Errorf("prefix %q, default branch %q: got %q, want %q", tc.prefix, tc.defaultBranch, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// optOutFooter is added to every PR body so maintainers know how to make
+// the bot go away.
+const optOutFooter = `
+
+---
+I am a bot. Closing this PR opts {{.Repo.FullName}} out of this fix; I won't open it again. Please reach out to [@azillion](https://github.com/azillion) if you have any issues.`
+
+// fileChange is a file a rule changed, with its line counts.
+type fileChange struct {
+	Path      string
+	Additions int
+	Deletions int
+}
+
+// templateData is what the title, body and commit templates of a rule are
+// executed with.
+type templateData struct {
+	Repo  *forgeRepo
+	Rule  *rule
+	Files []fileChange
+	// DiffStat summarizes Files, as in "1 file changed, 2 insertions(+),
+	// 2 deletions(-)".
+	DiffStat string
+}
+
+// prMessage is the rendered text of a fix.
+type prMessage struct {
+	Title string
+	Body  string
+	// Footer is the opt-out note that goes below Body.
+	Footer string
+	Commit string
+}
+
+// prBody returns the full PR description.
+func (m *prMessage) prBody() string {
+	return m.Body + m.Footer
+}
+
+// newFileChange counts the lines that differ between old and new.
+func newFileChange(path, old, new string) fileChange {
+	change := fileChange{Path: path}
+	for _, l := range diffLines(old, new) {
+		switch l.op {
+		case '+':
+			change.Additions++
+		case '-':
+			change.Deletions++
+		}
+	}
+	return change
+}
+
+// diffLine is a line of a diff: op is ' ' for a line both sides share, '-'
+// for a line only old has and '+' for one only new has.
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// diffLines diffs old and new line by line.
+func diffLines(old, new string) []diffLine {
+	a, b := strings.Split(old, "\n"), strings.Split(new, "\n")
+
+	// longest common subsequence of lines; the files are small
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] > lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+// unifiedDiff formats the changes between old and new to path as a unified
+// diff with three lines of context.
+func unifiedDiff(path, old, new string) string {
+	const context = 3
+	lines := diffLines(old, new)
+	// the empty line after the final newline is not a line of the file
+	if n := len(lines); n > 0 && lines[n-1] == (diffLine{' ', ""}) {
+		lines = lines[:n-1]
+	}
+
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "--- a/%s\n+++ b/%s\n", path, path)
+	for start := 0; start < len(lines); {
+		// find the next change and the end of its hunk
+		first := start
+		for first < len(lines) && lines[first].op == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		from := first - context
+		if from < start {
+			from = start
+		}
+		to, same := first, 0
+		for to < len(lines) && same <= 2*context {
+			if lines[to].op == ' ' {
+				same++
+			} else {
+				same = 0
+			}
+			to++
+		}
+		if same > context {
+			to -= same - context
+		}
+
+		// line numbers of the hunk on both sides
+		oldLine, newLine := 1, 1
+		for _, l := range lines[:from] {
+			if l.op != '+' {
+				oldLine++
+			}
+			if l.op != '-' {
+				newLine++
+			}
+		}
+		var oldCount, newCount int
+		for _, l := range lines[from:to] {
+			if l.op != '+' {
+				oldCount++
+			}
+			if l.op != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&buf, "@@ -%d,%d +%d,%d @@\n", oldLine, oldCount, newLine, newCount)
+		for _, l := range lines[from:to] {
+			fmt.Fprintf(&buf, "%c%s\n", l.op, l.text)
+		}
+		start = to
+	}
+	return buf.String()
+}
+
+// diffStat formats files the way git diff --stat ends.
+func diffStat(files []fileChange) string {
+	var add, del int
+	for _, f := range files {
+		add += f.Additions
+		del += f.Deletions
+	}
+	return fmt.Sprintf("%d %s changed, %d %s(+), %d %s(-)",
+		len(files), plural(len(files), "file", "files"),
+		add, plural(add, "insertion", "insertions"),
+		del, plural(del, "deletion", "deletions"))
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// render executes the templates of r for a fix of files in repo.
+func (r *rule) render(repo *forgeRepo, files []fileChange) (*prMessage, error) {
+	data := &templateData{Repo: repo, Rule: r, Files: files, DiffStat: diffStat(files)}
+
+	var (
+		msg prMessage
+		err error
+	)
+	if msg.Title, err = execTemplate(r.Name+" title", r.Title, data); err != nil {
+		return nil, err
+	}
+	if msg.Commit, err = execTemplate(r.Name+" commit", r.Commit, data); err != nil {
+		return nil, err
+	}
+	if msg.Body, err = execTemplate(r.Name+" body", r.Body, data); err != nil {
+		return nil, err
+	}
+	if msg.Footer, err = execTemplate("footer", optOutFooter, data); err != nil {
+		return nil, err
+	}
+	// Titles are a single line.
+	msg.Title = strings.Join(strings.Fields(msg.Title), " ")
+	if msg.Title == "" {
+		return nil, fmt.Errorf("title template of %s renders empty", r.Name)
+	}
+	msg.Commit = strings.TrimSpace(msg.Commit)
+	if msg.Commit == "" {
+		msg.Commit = msg.Title
+	}
+	msg.Commit = addFixerTrailers(msg.Commit, r)
+	return &msg, nil
+}
+
+func execTemplate(name, text string, data *templateData) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// loadTemplates overrides the templates of rules with the title.tmpl,
+// body.tmpl and commit.tmpl files found in dir/<rule name>/.
+func loadTemplates(dir string, rules []*rule) error {
+	for _, r := range rules {
+		for file, field := range map[string]*string{
+			"title.tmpl":  &r.Title,
+			"body.tmpl":   &r.Body,
+			"commit.tmpl": &r.Commit,
+		} {
+			p := filepath.Join(dir, r.Name, file)
+			b, err := ioutil.ReadFile(p)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := template.New(p).Parse(string(b)); err != nil {
+				return err
+			}
+			*field = string(b)
+		}
+	}
+	return nil
+}
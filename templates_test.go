@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// numberedLines returns lines "l1" to "ln", replacing those in changed
+// with "X<i>".
+func numberedLines(n int, changed ...int) string {
+	var buf strings.Builder
+	for i := 1; i <= n; i++ {
+		prefix := "l"
+		for _, c := range changed {
+			if c == i {
+				prefix = "X"
+			}
+		}
+		fmt.Fprintf(&buf, "%s%d\n", prefix, i)
+	}
+	return buf.String()
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	testCases := []struct {
+		name string
+		old  string
+		new  string
+		want string
+	}{
+		{
+			name: "no changes",
+			old:  "a\nb\n",
+			new:  "a\nb\n",
+			want: "",
+		},
+		{
+			name: "one line",
+			old:  "a\nb\nc\n",
+			new:  "a\nB\nc\n",
+			want: "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name: "changes far apart get a hunk each",
+			old:  numberedLines(20),
+			new:  numberedLines(20, 2, 18),
+			want: "@@ -1,5 +1,5 @@\n l1\n-l2\n+X2\n l3\n l4\n l5\n" +
+				"@@ -15,6 +15,6 @@\n l15\n l16\n l17\n-l18\n+X18\n l19\n l20\n",
+		},
+		{
+			name: "changes close together share a hunk",
+			old:  numberedLines(20),
+			new:  numberedLines(20, 5, 11),
+			want: "@@ -2,13 +2,13 @@\n l2\n l3\n l4\n-l5\n+X5\n l6\n l7\n l8\n l9\n l10\n-l11\n+X11\n l12\n l13\n l14\n",
+		},
+		{
+			name: "added at the end",
+			old:  "a\nb\n",
+			new:  "a\nb\nc\n",
+			want: "@@ -1,2 +1,3 @@\n a\n b\n+c\n",
+		},
+		{
+			name: "removed at the start",
+			old:  "a\nb\nc\nd\ne\nf\n",
+			new:  "b\nc\nd\ne\nf\n",
+			want: "@@ -1,4 +1,3 @@\n-a\n b\n c\n d\n",
+		},
+	}
+
+	for _, tc := range testCases {
+		want := "--- a/.travis.yml\n+++ b/.travis.yml\n" + tc.want
+		if got := unifiedDiff(".travis.yml", tc.old, tc.new); got != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tc.name, got, want)
+		}
+	}
+}
+
+func TestDiffStat(t *testing.T) {
+	testCases := []struct {
+		files []fileChange
+		want  string
+	}{
+		{nil, "0 files changed, 0 insertions(+), 0 deletions(-)"},
+		{[]fileChange{newFileChange(".travis.yml", "a\nb\n", "a\nB\n")}, "1 file changed, 1 insertion(+), 1 deletion(-)"},
+		{[]fileChange{{Additions: 2}, {Additions: 1, Deletions: 3}}, "2 files changed, 3 insertions(+), 3 deletions(-)"},
+	}
+
+	for _, tc := range testCases {
+		if got := diffStat(tc.files); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.files, got, tc.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	repo := &forgeRepo{Owner: "a", Name: "b"}
+	files := []fileChange{{Path: ".travis.yml", Additions: 1, Deletions: 1}}
+	testCases := []struct {
+		name       string
+		r          *rule
+		wantTitle  string
+		wantCommit string
+		wantErr    string
+	}{
+		{
+			name:       "title is a single line",
+			r:          &rule{Name: "r", Version: 1, Title: "Fix\n  {{.Repo.FullName}}  ", Commit: "Fix it\n\n{{.DiffStat}}\n"},
+			wantTitle:  "Fix a/b",
+			wantCommit: "Fix it\n\n1 file changed, 1 insertion(+), 1 deletion(-)\n\nFixer-Rule: r@v1",
+		},
+		{
+			name:       "commit defaults to the title",
+			r:          &rule{Name: "r", Version: 1, Title: "Fix {{.Rule.Name}}"},
+			wantTitle:  "Fix r",
+			wantCommit: "Fix r\n\nFixer-Rule: r@v1",
+		},
+		{
+			name:    "empty title",
+			r:       &rule{Name: "r", Title: "{{if false}}x{{end}}"},
+			wantErr: "renders empty",
+		},
+		{
+			name:    "unknown field",
+			r:       &rule{Name: "r", Title: "{{.Nope}}"},
+			wantErr: "can't evaluate field Nope",
+		},
+	}
+
+	for _, tc := range testCases {
+		msg, err := tc.r.render(repo, files)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: got error %v, want one containing %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if msg.Title != tc.wantTitle || msg.Commit != tc.wantCommit {
+			t.Errorf("%s: got title %q and commit %q, want %q and %q", tc.name, msg.Title, msg.Commit, tc.wantTitle, tc.wantCommit)
+		}
+		if !strings.Contains(msg.Footer, "opts a/b out") {
+			t.Errorf("%s: footer %q does not name the repo", tc.name, msg.Footer)
+		}
+	}
+}
+
+func TestLoadTemplates(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "r"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "r", "title.tmpl"), []byte("Custom title"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &rule{Name: "r", Title: "Default title", Body: "Default body"}
+	other := &rule{Name: "other", Title: "Other title"}
+	if err := loadTemplates(dir, []*rule{r, other}); err != nil {
+		t.Fatal(err)
+	}
+	if r.Title != "Custom title" || r.Body != "Default body" || other.Title != "Other title" {
+		t.Errorf("got titles %q and %q and body %q, want only the first title overridden", r.Title, other.Title, r.Body)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/azillion/ghb0t/version"
+)
+
+// The trailers every bot commit carries, so a commit found anywhere can be
+// traced back to the rule, campaign and binary that made it.
+const (
+	trailerRule     = "Fixer-Rule"
+	trailerCampaign = "Fixer-Campaign"
+	trailerVersion  = "Fixer-Version"
+)
+
+// ref names the rule at its current version, as in "golint-import@v1".
+func (r *rule) ref() string {
+	return fmt.Sprintf("%s@v%d", r.Name, r.Version)
+}
+
+// addFixerTrailers adds the provenance trailers for r to message.
+func addFixerTrailers(message string, r *rule) string {
+	message = addTrailer(message, trailerRule, r.ref())
+	if r.campaign != "" {
+		message = addTrailer(message, trailerCampaign, r.campaign)
+	}
+	if version.VERSION != "" {
+		message = addTrailer(message, trailerVersion, version.VERSION)
+	}
+	return message
+}
+
+// parseTrailers returns the trailers in the last paragraph of message.
+func parseTrailers(message string) map[string]string {
+	paragraphs := strings.Split(strings.TrimRight(message, "\n"), "\n\n")
+	if len(paragraphs) < 2 {
+		return nil
+	}
+	trailers := map[string]string{}
+	for _, line := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		if !trailerLine.MatchString(line) {
+			return nil
+		}
+		i := strings.Index(line, ": ")
+		trailers[line[:i]] = line[i+2:]
+	}
+	return trailers
+}
+
+// madeByBot reports whether the commit with message carries the trailer of
+// any rule, and so was made by the bot, whoever it was authored as.
+func madeByBot(message string) bool {
+	return parseTrailers(message)[trailerRule] != ""
+}
+
+// madeBy reports whether commit carries the trailer of r, at any version.
+func (r *rule) madeBy(commit *forgeCommit) bool {
+	ref := parseTrailers(commit.Message)[trailerRule]
+	return ref == r.Name || strings.HasPrefix(ref, r.Name+"@")
+}
+
+// trailerLine matches a git trailer like "Signed-off-by: A <a@example.com>".
+var trailerLine = regexp.MustCompile(`^[A-Za-z0-9-]+: `)
+
+// addTrailer appends a "key: value" trailer to message, joining the trailer
+// block at its end if there is one. A trailer already present is not added
+// twice.
+func addTrailer(message, key, value string) string {
+	message = strings.TrimRight(message, "\n")
+	trailer := key + ": " + value
+
+	paragraphs := strings.Split(message, "\n\n")
+	last := paragraphs[len(paragraphs)-1]
+	isTrailers := len(paragraphs) > 1
+	for _, line := range strings.Split(last, "\n") {
+		if line == trailer {
+			return message
+		}
+		if !trailerLine.MatchString(line) {
+			isTrailers = false
+		}
+	}
+	if isTrailers {
+		return message + "\n" + trailer
+	}
+	return message + "\n\n" + trailer
+}
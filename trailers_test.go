@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/azillion/ghb0t/version"
+)
+
+func TestAddTrailer(t *testing.T) {
+	testCases := []struct {
+		name    string
+		message string
+		want    string
+	}{
+		{"subject only", "Fix it", "Fix it\n\nFixer-Rule: r@v1"},
+		{"trailing newlines", "Fix it\n\n", "Fix it\n\nFixer-Rule: r@v1"},
+		{"body", "Fix it\n\nBecause.", "Fix it\n\nBecause.\n\nFixer-Rule: r@v1"},
+		{"joins a trailer block", "Fix it\n\nSigned-off-by: Bot <bot@example.com>", "Fix it\n\nSigned-off-by: Bot <bot@example.com>\nFixer-Rule: r@v1"},
+		{"already there", "Fix it\n\nFixer-Rule: r@v1", "Fix it\n\nFixer-Rule: r@v1"},
+		{"subject that looks like a trailer", "ci: fix it", "ci: fix it\n\nFixer-Rule: r@v1"},
+		{"body ending in prose with a colon", "Fix it\n\nNote: this is prose\nand more", "Fix it\n\nNote: this is prose\nand more\n\nFixer-Rule: r@v1"},
+	}
+
+	for _, tc := range testCases {
+		if got := addTrailer(tc.message, trailerRule, "r@v1"); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseTrailers(t *testing.T) {
+	testCases := []struct {
+		name    string
+		message string
+		want    map[string]string
+	}{
+		{"subject only", "Fixer-Rule: r@v1", nil},
+		{"no trailers", "Fix it\n\nBecause.", nil},
+		{"mixed last paragraph", "Fix it\n\nFixer-Rule: r@v1\nand prose", nil},
+		{
+			"trailers",
+			"Fix it\n\nBecause.\n\nSigned-off-by: Bot <bot@example.com>\nFixer-Rule: r@v1\nFixer-Campaign: spring\n",
+			map[string]string{"Signed-off-by": "Bot <bot@example.com>", trailerRule: "r@v1", trailerCampaign: "spring"},
+		},
+	}
+
+	for _, tc := range testCases {
+		if got := parseTrailers(tc.message); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAddFixerTrailers(t *testing.T) {
+	defer func(v string) { version.VERSION = v }(version.VERSION)
+
+	testCases := []struct {
+		name     string
+		campaign string
+		version  string
+		want     string
+	}{
+		{"rule only", "", "", "Fix it\n\nFixer-Rule: golint-import@v2"},
+		{"campaign and version", "spring", "v0.3.0", "Fix it\n\nFixer-Rule: golint-import@v2\nFixer-Campaign: spring\nFixer-Version: v0.3.0"},
+	}
+
+	for _, tc := range testCases {
+		version.VERSION = tc.version
+		r := &rule{Name: "golint-import", Version: 2, campaign: tc.campaign}
+		if got := addFixerTrailers("Fix it", r); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMadeBy(t *testing.T) {
+	r := &rule{Name: "golint-import", Version: 2}
+	testCases := []struct {
+		name       string
+		message    string
+		wantBot    bool
+		wantByRule bool
+	}{
+		{"this rule at another version", "Fix it\n\nFixer-Rule: golint-import@v1", true, true},
+		{"this rule without a version", "Fix it\n\nFixer-Rule: golint-import", true, true},
+		{"another rule", "Fix it\n\nFixer-Rule: golint-import-extra@v1", true, false},
+		{"no trailers", "Fix it", false, false},
+		{"trailer text in the subject", "Drop Fixer-Rule: golint-import@v1", false, false},
+		{"other trailers only", "Fix it\n\nSigned-off-by: Someone <s@example.com>", false, false},
+	}
+
+	for _, tc := range testCases {
+		if got := madeByBot(tc.message); got != tc.wantBot {
+			t.Errorf("%s: madeByBot got %t, want %t", tc.name, got, tc.wantBot)
+		}
+		if got := r.madeBy(&forgeCommit{Message: tc.message}); got != tc.wantByRule {
+			t.Errorf("%s: madeBy got %t, want %t", tc.name, got, tc.wantByRule)
+		}
+	}
+}